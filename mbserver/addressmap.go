@@ -0,0 +1,109 @@
+package mbserver
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Access is the access masters have to a mapped address range.
+type Access int
+
+const (
+	// ReadWrite ranges can be read and written by masters.
+	ReadWrite Access = iota
+	// ReadOnly ranges can be read but not written by masters.
+	ReadOnly
+)
+
+func (a Access) String() string {
+	switch a {
+	case ReadWrite:
+		return "ReadWrite"
+	case ReadOnly:
+		return "ReadOnly"
+	}
+	return "unknown"
+}
+
+// AddressRange is a range of addresses that exist in a memory map.
+type AddressRange struct {
+	Start    uint16
+	Quantity int
+	Access   Access
+}
+
+func (r AddressRange) end() int {
+	return int(r.Start) + r.Quantity
+}
+
+// MapAddresses adds a range of addresses that masters can access in a table.
+// Once a table has a mapped range, masters get IllegalDataAddress for any
+// address outside the mapped ranges and for writes to read-only ranges.
+// Tables without mapped ranges can be accessed at every address. The
+// address maps only restrict masters, the Read and Write methods can access
+// every address.
+func (s *Server) MapAddresses(table Table, start uint16, quantity int, access Access) error {
+	r := AddressRange{Start: start, Quantity: quantity, Access: access}
+	if quantity < 1 || r.end() > memorySize {
+		return fmt.Errorf("address range %d+%d is outside the memory map", start, quantity)
+	}
+
+	s.addressMapMu.Lock()
+	defer s.addressMapMu.Unlock()
+	if s.addressMaps == nil {
+		s.addressMaps = make(map[Table][]AddressRange)
+	}
+	ranges := s.addressMaps[table]
+	for _, mapped := range ranges {
+		if int(r.Start) < mapped.end() && int(mapped.Start) < r.end() {
+			return fmt.Errorf("address range %d+%d overlaps mapped range %d+%d", start, quantity, mapped.Start, mapped.Quantity)
+		}
+	}
+	ranges = append(ranges, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	s.addressMaps[table] = ranges
+	return nil
+}
+
+// AddressRanges returns the mapped address ranges of a table, in address
+// order.
+func (s *Server) AddressRanges(table Table) []AddressRange {
+	s.addressMapMu.RLock()
+	defer s.addressMapMu.RUnlock()
+	return append([]AddressRange{}, s.addressMaps[table]...)
+}
+
+// ClearAddressMap removes the mapped address ranges of a table, making every
+// address accessible again.
+func (s *Server) ClearAddressMap(table Table) {
+	s.addressMapMu.Lock()
+	defer s.addressMapMu.Unlock()
+	delete(s.addressMaps, table)
+}
+
+// mapped reports whether masters can read, or with write set write, n
+// addresses of a table from address. Adjacent ranges can be accessed in one
+// request.
+func (s *Server) mapped(table Table, address uint16, n int, write bool) bool {
+	s.addressMapMu.RLock()
+	defer s.addressMapMu.RUnlock()
+
+	ranges, ok := s.addressMaps[table]
+	if !ok {
+		return true
+	}
+	next, end := int(address), int(address)+n
+	for _, r := range ranges {
+		if next >= end {
+			break
+		}
+		if r.end() <= next {
+			continue
+		}
+		if int(r.Start) > next || (write && r.Access == ReadOnly) {
+			return false
+		}
+		next = r.end()
+	}
+	return next >= end
+}
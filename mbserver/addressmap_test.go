@@ -0,0 +1,64 @@
+package mbserver
+
+import "testing"
+
+func TestAddressMap(t *testing.T) {
+	s := NewServer()
+	if err := s.MapAddresses(HoldingRegisters, 100, 10, ReadWrite); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := s.MapAddresses(HoldingRegisters, 110, 5, ReadOnly); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if err := s.MapAddresses(HoldingRegisters, 105, 10, ReadWrite); err == nil {
+		t.Errorf("expected overlap error, got nil")
+	}
+
+	var frame TCPFrame
+	frame.Device = 1
+	var req Request
+	req.frame = &frame
+
+	tests := []struct {
+		function uint8
+		address  uint16
+		number   uint16
+		expect   Exception
+	}{
+		{3, 100, 15, Success},           // Adjacent ranges.
+		{3, 99, 2, IllegalDataAddress},  // Starts before the map.
+		{3, 110, 6, IllegalDataAddress}, // Ends after the map.
+		{6, 109, 1, Success},
+		{6, 110, 1, IllegalDataAddress}, // Read-only.
+		{4, 0, 1, Success},              // Input registers are not mapped.
+	}
+	for _, test := range tests {
+		frame.Function = test.function
+		SetDataWithRegisterAndNumber(&frame, test.address, test.number)
+		response := s.handle(&req)
+		if exception := GetException(response); exception != test.expect {
+			t.Errorf("function %v address %v: expected %v, got %v", test.function, test.address, test.expect, exception)
+		}
+	}
+
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 108, 3, []uint16{1, 2, 3})
+	if exception := GetException(s.handle(&req)); exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception)
+	}
+	values, _ := s.ReadHolding(108, 3)
+	expect := []uint16{0, 1, 0}
+	if !isEqual(expect, values) {
+		t.Errorf("expected %v, got %v", expect, values)
+	}
+
+	s.ClearAddressMap(HoldingRegisters)
+	if len(s.AddressRanges(HoldingRegisters)) != 0 {
+		t.Errorf("expected no ranges, got %v", s.AddressRanges(HoldingRegisters))
+	}
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+	if exception := GetException(s.handle(&req)); exception != Success {
+		t.Errorf("expected Success, got %v", exception)
+	}
+}
@@ -0,0 +1,305 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Link types of the capture interfaces. There is no link type assigned to
+// Modbus RTU, so serial frames use the user link types; in Wireshark map
+// DLT_USER0 (147) to the mbrtu protocol to decode them.
+const (
+	linkTypeEthernet  = 1
+	linkTypeModbusRTU = 147
+	linkTypeASCII     = 148
+)
+
+// Capture interface IDs, in the order their description blocks are written.
+const (
+	captureEthernet = iota
+	captureRTU
+	captureASCII
+)
+
+// Synthetic MAC addresses of masters and of the server.
+var (
+	captureMasterMAC = []byte{0x02, 0, 0, 0, 0, 0x01}
+	captureServerMAC = []byte{0x02, 0, 0, 0, 0, 0x02}
+)
+
+// capture writes request and response ADUs to a pcapng stream.
+type capture struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+	// seq holds the next TCP sequence numbers of the master and the server
+	// of each open connection, by remote address.
+	seq map[string]*[2]uint32
+}
+
+// StartCapture writes every request and response ADU the server handles to
+// w in pcapng format, until StopCapture is called. Modbus TCP, RTU over TCP,
+// ASCII over TCP, Modbus/TCP Security (unencrypted) and UDP traffic is
+// wrapped in synthetic Ethernet, IP and TCP or UDP headers. Frames on serial
+// lines are captured on separate interfaces, RTU with link type DLT_USER0
+// (147) and ASCII with DLT_USER1 (148). Timestamps have nanosecond
+// resolution; requests are stamped when they were received and responses
+// when they are written.
+func (s *Server) StartCapture(w io.Writer) error {
+	c := &capture{w: w, seq: make(map[string]*[2]uint32)}
+	c.writeHeader()
+	if c.err != nil {
+		return c.err
+	}
+
+	s.captureMu.Lock()
+	defer s.captureMu.Unlock()
+	s.capture = c
+	return nil
+}
+
+// StopCapture stops writing the server's traffic to the capture writer and
+// returns the first error writing to it. It does not close the writer.
+func (s *Server) StopCapture() error {
+	s.captureMu.Lock()
+	c := s.capture
+	s.capture = nil
+	s.captureMu.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// captureADU writes a request (inbound) or response ADU to the capture, if
+// one is running.
+func (s *Server) captureADU(request *Request, adu []byte, inbound bool, timestamp time.Time) {
+	s.captureMu.Lock()
+	c := s.capture
+	s.captureMu.Unlock()
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch transport(request) {
+	case TransportRTU:
+		c.writePacket(captureRTU, adu, inbound, timestamp)
+	case TransportASCII:
+		c.writePacket(captureASCII, adu, inbound, timestamp)
+	case TransportUDP:
+		conn := request.conn.(*udpConn)
+		c.writePacket(captureEthernet, c.ethernet(conn.LocalAddr(), conn.RemoteAddr(), adu, inbound, false), inbound, timestamp)
+	default:
+		conn, ok := request.conn.(net.Conn)
+		if !ok {
+			return
+		}
+		c.writePacket(captureEthernet, c.ethernet(conn.LocalAddr(), conn.RemoteAddr(), adu, inbound, true), inbound, timestamp)
+	}
+}
+
+// captureClosed forgets the TCP sequence numbers of a closed connection.
+func (s *Server) captureClosed(conn net.Conn) {
+	s.captureMu.Lock()
+	c := s.capture
+	s.captureMu.Unlock()
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seq, conn.RemoteAddr().String())
+}
+
+// writeBlock writes a pcapng block with the given type and body.
+func (c *capture) writeBlock(blockType uint32, body []byte) {
+	if c.err != nil {
+		return
+	}
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(12 + len(body))
+	var block bytes.Buffer
+	binary.Write(&block, binary.LittleEndian, blockType)
+	binary.Write(&block, binary.LittleEndian, length)
+	block.Write(body)
+	binary.Write(&block, binary.LittleEndian, length)
+	_, c.err = c.w.Write(block.Bytes())
+}
+
+// writeHeader writes the section header block and the interface description
+// blocks.
+func (c *capture) writeHeader() {
+	var shb bytes.Buffer
+	binary.Write(&shb, binary.LittleEndian, uint32(0x1A2B3C4D)) // Byte-order magic.
+	binary.Write(&shb, binary.LittleEndian, uint16(1))          // Major version.
+	binary.Write(&shb, binary.LittleEndian, uint16(0))          // Minor version.
+	binary.Write(&shb, binary.LittleEndian, int64(-1))          // Unknown section length.
+	c.writeBlock(0x0A0D0D0A, shb.Bytes())
+
+	for _, linkType := range []uint16{linkTypeEthernet, linkTypeModbusRTU, linkTypeASCII} {
+		var idb bytes.Buffer
+		binary.Write(&idb, binary.LittleEndian, linkType)
+		binary.Write(&idb, binary.LittleEndian, uint16(0))
+		binary.Write(&idb, binary.LittleEndian, uint32(0)) // No snapshot length limit.
+		idb.Write([]byte{9, 0, 1, 0, 9, 0, 0, 0})          // if_tsresol: nanoseconds.
+		idb.Write([]byte{0, 0, 0, 0})                      // opt_endofopt.
+		c.writeBlock(1, idb.Bytes())
+	}
+}
+
+// writePacket writes an enhanced packet block.
+func (c *capture) writePacket(interfaceID uint32, packet []byte, inbound bool, timestamp time.Time) {
+	ns := uint64(timestamp.UnixNano())
+	var epb bytes.Buffer
+	binary.Write(&epb, binary.LittleEndian, interfaceID)
+	binary.Write(&epb, binary.LittleEndian, uint32(ns>>32))
+	binary.Write(&epb, binary.LittleEndian, uint32(ns))
+	binary.Write(&epb, binary.LittleEndian, uint32(len(packet))) // Captured length.
+	binary.Write(&epb, binary.LittleEndian, uint32(len(packet))) // Original length.
+	epb.Write(packet)
+	for epb.Len()%4 != 0 {
+		epb.WriteByte(0)
+	}
+	// epb_flags: the direction of the packet.
+	direction := uint32(2)
+	if inbound {
+		direction = 1
+	}
+	epb.Write([]byte{2, 0, 4, 0})
+	binary.Write(&epb, binary.LittleEndian, direction)
+	epb.Write([]byte{0, 0, 0, 0}) // opt_endofopt.
+	c.writeBlock(6, epb.Bytes())
+}
+
+// ethernet wraps an ADU in Ethernet, IP and TCP or UDP headers, from the
+// master to the server when inbound.
+func (c *capture) ethernet(local, remote net.Addr, adu []byte, inbound, tcp bool) []byte {
+	serverIP, serverPort := splitAddr(local)
+	masterIP, masterPort := splitAddr(remote)
+
+	var transport []byte
+	var protocol byte
+	srcIP, dstIP := serverIP, masterIP
+	srcPort, dstPort := serverPort, masterPort
+	if inbound {
+		srcIP, dstIP = masterIP, serverIP
+		srcPort, dstPort = masterPort, serverPort
+	}
+	if tcp {
+		protocol = 6
+		seq, ok := c.seq[remote.String()]
+		if !ok {
+			seq = &[2]uint32{}
+			c.seq[remote.String()] = seq
+		}
+		from, to := 1, 0
+		if inbound {
+			from, to = 0, 1
+		}
+		transport = make([]byte, 20, 20+len(adu))
+		binary.BigEndian.PutUint16(transport[0:2], srcPort)
+		binary.BigEndian.PutUint16(transport[2:4], dstPort)
+		binary.BigEndian.PutUint32(transport[4:8], seq[from])
+		binary.BigEndian.PutUint32(transport[8:12], seq[to])
+		transport[12] = 5 << 4                               // Data offset.
+		transport[13] = 0x18                                 // PSH, ACK.
+		binary.BigEndian.PutUint16(transport[14:16], 0xFFFF) // Window.
+		seq[from] += uint32(len(adu))
+	} else {
+		protocol = 17
+		transport = make([]byte, 8, 8+len(adu))
+		binary.BigEndian.PutUint16(transport[0:2], srcPort)
+		binary.BigEndian.PutUint16(transport[2:4], dstPort)
+		binary.BigEndian.PutUint16(transport[4:6], uint16(8+len(adu)))
+	}
+	transport = append(transport, adu...)
+
+	v4 := srcIP.To4() != nil && dstIP.To4() != nil
+	var pseudo []byte
+	if v4 {
+		pseudo = append(append(pseudo, srcIP.To4()...), dstIP.To4()...)
+		pseudo = append(pseudo, 0, protocol, byte(len(transport)>>8), byte(len(transport)))
+	} else {
+		pseudo = append(append(pseudo, srcIP.To16()...), dstIP.To16()...)
+		pseudo = append(pseudo, 0, 0, byte(len(transport)>>8), byte(len(transport)), 0, 0, 0, protocol)
+	}
+	checksumAt := 16
+	if !tcp {
+		checksumAt = 6
+	}
+	binary.BigEndian.PutUint16(transport[checksumAt:], internetChecksum(append(pseudo, transport...)))
+
+	var ip []byte
+	if v4 {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(transport)))
+		ip[6] = 0x40 // Don't fragment.
+		ip[8] = 64   // TTL.
+		ip[9] = protocol
+		copy(ip[12:16], srcIP.To4())
+		copy(ip[16:20], dstIP.To4())
+		binary.BigEndian.PutUint16(ip[10:12], internetChecksum(ip))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(transport)))
+		ip[6] = protocol
+		ip[7] = 64 // Hop limit.
+		copy(ip[8:24], srcIP.To16())
+		copy(ip[24:40], dstIP.To16())
+	}
+
+	srcMAC, dstMAC := captureServerMAC, captureMasterMAC
+	if inbound {
+		srcMAC, dstMAC = captureMasterMAC, captureServerMAC
+	}
+	frame := make([]byte, 0, 14+len(ip)+len(transport))
+	frame = append(append(frame, dstMAC...), srcMAC...)
+	if v4 {
+		frame = append(frame, 0x08, 0x00)
+	} else {
+		frame = append(frame, 0x86, 0xDD)
+	}
+	return append(append(frame, ip...), transport...)
+}
+
+// splitAddr returns the IP address and port of a TCP or UDP address, or the
+// unspecified address.
+func splitAddr(addr net.Addr) (net.IP, uint16) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port)
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port)
+	}
+	return net.IPv4zero, 0
+}
+
+// internetChecksum returns the ones' complement checksum used by IP, TCP and
+// UDP.
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
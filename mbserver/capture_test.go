@@ -0,0 +1,227 @@
+package mbserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// capturedPacket is an enhanced packet block read back from a capture.
+type capturedPacket struct {
+	iface   uint32
+	time    time.Time
+	inbound bool
+	data    []byte
+}
+
+// readCapture parses a pcapng capture written by a server and returns the
+// link types of its interfaces and its packets.
+func readCapture(t *testing.T, capture []byte) ([]uint16, []capturedPacket) {
+	t.Helper()
+	var linkTypes []uint16
+	var packets []capturedPacket
+	for len(capture) > 0 {
+		if len(capture) < 12 {
+			t.Fatalf("expected a block, got %v bytes", len(capture))
+		}
+		blockType := binary.LittleEndian.Uint32(capture)
+		length := binary.LittleEndian.Uint32(capture[4:])
+		if length%4 != 0 || int(length) > len(capture) || binary.LittleEndian.Uint32(capture[length-4:]) != length {
+			t.Fatalf("bad block length %v", length)
+		}
+		body := capture[8 : length-4]
+		switch blockType {
+		case 0x0A0D0D0A:
+			if binary.LittleEndian.Uint32(body) != 0x1A2B3C4D {
+				t.Fatalf("bad byte-order magic %x", body[:4])
+			}
+		case 1:
+			linkTypes = append(linkTypes, binary.LittleEndian.Uint16(body))
+			if !isEqual(body[8:16], []byte{9, 0, 1, 0, 9, 0, 0, 0}) {
+				t.Errorf("expected nanosecond resolution, got options %v", body[8:])
+			}
+		case 6:
+			ns := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+			n := binary.LittleEndian.Uint32(body[12:])
+			options := body[20+(n+3)/4*4:]
+			packets = append(packets, capturedPacket{
+				iface:   binary.LittleEndian.Uint32(body),
+				time:    time.Unix(0, int64(ns)),
+				inbound: binary.LittleEndian.Uint32(options[4:]) == 1,
+				data:    body[20 : 20+n],
+			})
+		default:
+			t.Fatalf("unexpected block type %v", blockType)
+		}
+		capture = capture[length:]
+	}
+	return linkTypes, packets
+}
+
+func TestCaptureTCP(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.WriteHolding(5, []uint16{0x1234})
+	var capture bytes.Buffer
+	if err := s.StartCapture(&capture); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	before := time.Now()
+	var requests [][]byte
+	for i := uint16(1); i <= 2; i++ {
+		frame := &TCPFrame{TransactionIdentifier: i, Device: 1, Function: 3}
+		SetDataWithRegisterAndNumber(frame, 5, 1)
+		requests = append(requests, frame.Bytes())
+		conn.Write(frame.Bytes())
+		response := make([]byte, 11)
+		if _, err := conn.Read(response); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+	}
+	after := time.Now()
+	if err := s.StopCapture(); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	linkTypes, packets := readCapture(t, capture.Bytes())
+	if !isEqual([]uint16{1, 147, 148}, linkTypes) {
+		t.Errorf("expected %v, got %v", []uint16{1, 147, 148}, linkTypes)
+	}
+	if len(packets) != 4 {
+		t.Fatalf("expected 4 packets, got %v", len(packets))
+	}
+
+	client := conn.LocalAddr().(*net.TCPAddr)
+	server := conn.RemoteAddr().(*net.TCPAddr)
+	var last time.Time
+	for i, packet := range packets {
+		if packet.iface != captureEthernet {
+			t.Errorf("expected interface %v, got %v", captureEthernet, packet.iface)
+		}
+		if packet.inbound != (i%2 == 0) {
+			t.Errorf("expected inbound %v, got %v", i%2 == 0, packet.inbound)
+		}
+		if packet.time.Before(before) || packet.time.After(after) || packet.time.Before(last) {
+			t.Errorf("timestamp %v out of order or outside %v - %v", packet.time, before, after)
+		}
+		last = packet.time
+
+		data := packet.data
+		if !isEqual([]byte{0x08, 0x00}, data[12:14]) {
+			t.Fatalf("expected IPv4, got ethertype %x", data[12:14])
+		}
+		ip := data[14:34]
+		if internetChecksum(ip) != 0 {
+			t.Errorf("bad IP header checksum")
+		}
+		if ip[9] != 6 {
+			t.Errorf("expected TCP, got protocol %v", ip[9])
+		}
+		segment := data[34:]
+		pseudo := append(append([]byte{}, ip[12:20]...), 0, 6, byte(len(segment)>>8), byte(len(segment)))
+		if internetChecksum(append(pseudo, segment...)) != 0 {
+			t.Errorf("bad TCP checksum")
+		}
+
+		srcPort, dstPort := binary.BigEndian.Uint16(segment), binary.BigEndian.Uint16(segment[2:])
+		if packet.inbound {
+			if int(srcPort) != client.Port || int(dstPort) != server.Port {
+				t.Errorf("expected ports %v > %v, got %v > %v", client.Port, server.Port, srcPort, dstPort)
+			}
+			if !isEqual(requests[i/2], segment[20:]) {
+				t.Errorf("expected %v, got %v", requests[i/2], segment[20:])
+			}
+		} else if int(srcPort) != server.Port || int(dstPort) != client.Port {
+			t.Errorf("expected ports %v > %v, got %v > %v", server.Port, client.Port, srcPort, dstPort)
+		}
+
+		// Sequence numbers advance by the payload sent in each direction.
+		seq, ack := binary.BigEndian.Uint32(segment[4:]), binary.BigEndian.Uint32(segment[8:])
+		expectSeq, expectAck := uint32(i/2*12), uint32(i/2*11)
+		if !packet.inbound {
+			expectSeq, expectAck = uint32(i/2*11), uint32(i/2*12+12)
+		}
+		if seq != expectSeq || ack != expectAck {
+			t.Errorf("expected seq %v ack %v, got %v %v", expectSeq, expectAck, seq, ack)
+		}
+	}
+
+	expect := []byte{0, 2, 0, 0, 0, 5, 1, 3, 2, 0x12, 0x34}
+	if got := packets[3].data[54:]; !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestCaptureForgetsClosedConnections(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	var capture bytes.Buffer
+	s.StartCapture(&capture)
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn := connectAndRead(t, addr, 1)
+		conn.Close()
+	}
+	for deadline := time.Now().Add(time.Second); len(s.Connections()) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.capture.mu.Lock()
+	defer s.capture.mu.Unlock()
+	if len(s.capture.seq) != 0 {
+		t.Errorf("expected no sequence numbers, got %v", s.capture.seq)
+	}
+}
+
+func TestCaptureRTU(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.WriteHolding(5, []uint16{0x1234})
+	var capture bytes.Buffer
+	s.StartCapture(&capture)
+
+	frame := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 5, 1)
+	port := newFakePort()
+	s.respond(&Request{conn: port, frame: frame, received: time.Now()})
+	response := <-port.writes
+	s.StopCapture()
+
+	// Traffic after StopCapture is not captured.
+	s.respond(&Request{conn: port, frame: frame, received: time.Now()})
+	<-port.writes
+
+	_, packets := readCapture(t, capture.Bytes())
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets, got %v", len(packets))
+	}
+	for _, packet := range packets {
+		if packet.iface != captureRTU {
+			t.Errorf("expected interface %v, got %v", captureRTU, packet.iface)
+		}
+	}
+	if !packets[0].inbound || !isEqual(frame.Bytes(), packets[0].data) {
+		t.Errorf("expected inbound %v, got %v %v", frame.Bytes(), packets[0].inbound, packets[0].data)
+	}
+	if packets[1].inbound || !isEqual(response, packets[1].data) {
+		t.Errorf("expected outbound %v, got %v %v", response, packets[1].inbound, packets[1].data)
+	}
+}
@@ -0,0 +1,436 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// ErrTimeout is returned by a Client when no response is received in time.
+var ErrTimeout = errors.New("mbserver: request timed out")
+
+// defaultClientTimeout limits each attempt of a request when the client's
+// Timeout is 0.
+const defaultClientTimeout = time.Second
+
+// serialPollInterval is the read timeout of serial ports opened with no
+// timeout, so that the client can give up on a request.
+const serialPollInterval = 50 * time.Millisecond
+
+// Client is a Modbus master. It sends one request at a time over Modbus TCP,
+// RTU over TCP or a serial line, and is safe for concurrent use.
+type Client struct {
+	// Timeout limits each attempt of a request, 1 second if 0.
+	Timeout time.Duration
+	// Retries is the number of times a request is sent again after a
+	// timeout, a bad response or a connection error. Exception responses
+	// are not retried.
+	Retries int
+
+	mu          sync.Mutex
+	transport   Transport
+	dial        func() (io.ReadWriteCloser, error)
+	conn        io.ReadWriteCloser
+	silence     time.Duration
+	lastIO      time.Time
+	transaction uint16
+}
+
+// DialTCP connects a Modbus TCP client to "address:port".
+func DialTCP(addressPort string) (*Client, error) {
+	return dialNetwork(TransportTCP, addressPort)
+}
+
+// DialRTUTCP connects a client sending RTU frames over TCP to
+// "address:port".
+func DialRTUTCP(addressPort string) (*Client, error) {
+	return dialNetwork(TransportRTUTCP, addressPort)
+}
+
+// dialNetwork connects a client of a TCP transport.
+func dialNetwork(transport Transport, addressPort string) (*Client, error) {
+	c := &Client{transport: transport}
+	c.dial = func() (io.ReadWriteCloser, error) {
+		return net.DialTimeout("tcp", addressPort, c.timeout())
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialRTU opens a serial device for a Modbus RTU client.
+// For example:  c, err := mbserver.DialRTU(&serial.Config{Address: "/dev/ttyUSB0"})
+func DialRTU(serialConfig *serial.Config) (*Client, error) {
+	config := *serialConfig
+	if config.Timeout <= 0 || config.Timeout > serialPollInterval {
+		config.Timeout = serialPollInterval
+	}
+	c := &Client{transport: TransportRTU, silence: rtuFrameSilence(config.BaudRate)}
+	c.dial = func() (io.ReadWriteCloser, error) {
+		return serial.Open(&config)
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the client's connection or serial port.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultClientTimeout
+}
+
+// connect opens the connection or serial port if it is not open.
+func (c *Client) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+// Send sends a request and returns the response. The request can be a
+// TCPFrame, RTUFrame or ASCIIFrame, built for example with
+// SetDataWithRegisterAndNumber; its unit, function and data are sent in the
+// framing of the client's transport. An exception response is returned with
+// its Exception as the error. Broadcasts, to unit 0 on RTU transports, are
+// not answered and return a nil response.
+func (c *Client) Send(request Framer) (Framer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		var response Framer
+		response, err = c.exchange(request)
+		if err == nil {
+			if exception := GetException(response); exception != Success {
+				return response, exception
+			}
+			return response, nil
+		}
+		if err != ErrTimeout && c.conn != nil {
+			// The connection may be broken or out of step, start afresh.
+			c.conn.Close()
+			c.conn = nil
+		}
+	}
+	return nil, err
+}
+
+// connectError is returned by a Client that cannot open its connection or
+// serial port.
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+// exchange makes one attempt at a request.
+func (c *Client) exchange(request Framer) (Framer, error) {
+	if err := c.connect(); err != nil {
+		return nil, &connectError{err}
+	}
+
+	var frame Framer
+	if c.transport == TransportTCP {
+		c.transaction++
+		frame = &TCPFrame{
+			TransactionIdentifier: c.transaction,
+			Device:                request.GetUnitID(),
+			Function:              request.GetFunction(),
+		}
+	} else {
+		frame = &RTUFrame{Address: request.GetUnitID(), Function: request.GetFunction()}
+	}
+	frame.SetData(request.GetData())
+
+	// RTU frames on a serial line are separated by a silent interval.
+	if wait := c.silence - time.Since(c.lastIO); wait > 0 {
+		time.Sleep(wait)
+	}
+	_, err := c.conn.Write(frame.Bytes())
+	c.lastIO = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	if c.transport != TransportTCP && frame.GetUnitID() == 0 {
+		return nil, nil
+	}
+
+	deadline := time.Now().Add(c.timeout())
+	var response Framer
+	if c.transport == TransportTCP {
+		response, err = c.readTCPResponse(frame.(*TCPFrame), deadline)
+	} else {
+		response, err = c.readRTUResponse(deadline)
+	}
+	c.lastIO = time.Now()
+	if err != nil {
+		return nil, err
+	}
+
+	if response.GetUnitID() != frame.GetUnitID() || response.GetFunction()&0x7F != frame.GetFunction() {
+		return nil, fmt.Errorf("mbserver: response from unit %d function %d to request to unit %d function %d",
+			response.GetUnitID(), response.GetFunction(), frame.GetUnitID(), frame.GetFunction())
+	}
+	return response, nil
+}
+
+// read reads from the connection until deadline. Serial ports time out
+// every serialPollInterval, so reads are repeated until the deadline.
+func (c *Client) read(b []byte, deadline time.Time) (int, error) {
+	if conn, ok := c.conn.(net.Conn); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	for {
+		n, err := c.conn.Read(b)
+		if err == serial.ErrTimeout {
+			if time.Now().Before(deadline) {
+				continue
+			}
+			return n, ErrTimeout
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return n, ErrTimeout
+		}
+		return n, err
+	}
+}
+
+// clientReader reads a client's connection until a deadline.
+type clientReader struct {
+	c        *Client
+	deadline time.Time
+}
+
+func (r clientReader) Read(b []byte) (int, error) {
+	return r.c.read(b, r.deadline)
+}
+
+// readTCPResponse reads the response to a Modbus TCP request, skipping late
+// responses to earlier attempts.
+func (c *Client) readTCPResponse(request *TCPFrame, deadline time.Time) (Framer, error) {
+	for {
+		response, err := readTCPFrame(clientReader{c, deadline})
+		if err != nil {
+			return nil, err
+		}
+		if response.TransactionIdentifier == request.TransactionIdentifier {
+			return response, nil
+		}
+	}
+}
+
+// readRTUResponse reads an RTU response. Its length is worked out from the
+// function code and byte count, or, for functions of unknown length, it ends
+// where the CRC matches.
+func (c *Client) readRTUResponse(deadline time.Time) (Framer, error) {
+	var buffer []byte
+	packet := make([]byte, 512)
+	for {
+		n, err := c.read(packet, deadline)
+		if err != nil {
+			return nil, err
+		}
+		buffer = append(buffer, packet[:n]...)
+
+		length := rtuResponseLength(buffer)
+		switch {
+		case length > 0 && len(buffer) >= length:
+			return NewRTUFrame(buffer[:length])
+		case length < 0 && len(buffer) >= 4:
+			if frame, err := NewRTUFrame(buffer); err == nil {
+				return frame, nil
+			}
+		}
+	}
+}
+
+// rtuResponseLength returns the length of the RTU response ADU at the start
+// of packet, like rtuRequestLength does for requests.
+func rtuResponseLength(packet []byte) int {
+	if len(packet) < 2 {
+		return 0
+	}
+	if packet[1]&0x80 != 0 {
+		return 5
+	}
+	switch packet[1] {
+	case 1, 2, 3, 4, 12, 17, 20, 21, 23:
+		if len(packet) < 3 {
+			return 0
+		}
+		return 5 + int(packet[2])
+	case 5, 6, 11, 15, 16:
+		return 8
+	case 8:
+		if len(packet) < 4 {
+			return 0
+		}
+		if binary.BigEndian.Uint16(packet[2:4]) == diagReturnQueryData {
+			return -1
+		}
+		return 8
+	case 7:
+		return 5
+	case 22:
+		return 10
+	case 24:
+		if len(packet) < 4 {
+			return 0
+		}
+		return 6 + int(binary.BigEndian.Uint16(packet[2:4]))
+	}
+	return -1
+}
+
+// sendData sends a request and returns the data of the response.
+func (c *Client) sendData(request Framer) ([]byte, error) {
+	response, err := c.Send(request)
+	if err != nil || response == nil {
+		return nil, err
+	}
+	return response.GetData(), nil
+}
+
+// readBits reads coils or discrete inputs.
+func (c *Client) readBits(unit, function uint8, address, quantity uint16) ([]bool, error) {
+	frame := &TCPFrame{Device: unit, Function: function}
+	SetDataWithRegisterAndNumber(frame, address, quantity)
+	data, err := c.sendData(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 || int(data[0]) != (int(quantity)+7)/8 || len(data) != 1+int(data[0]) {
+		return nil, fmt.Errorf("mbserver: bad response data %v", data)
+	}
+	values := make([]bool, quantity)
+	for i := range values {
+		values[i] = bitAtPosition(data[1+i/8], uint(i)%8) == 1
+	}
+	return values, nil
+}
+
+// readRegisters reads holding or input registers.
+func (c *Client) readRegisters(unit, function uint8, address, quantity uint16) ([]uint16, error) {
+	frame := &TCPFrame{Device: unit, Function: function}
+	SetDataWithRegisterAndNumber(frame, address, quantity)
+	data, err := c.sendData(frame)
+	if err != nil {
+		return nil, err
+	}
+	return registerValues(data, quantity)
+}
+
+// registerValues decodes the byte count and values of a read response.
+func registerValues(data []byte, quantity uint16) ([]uint16, error) {
+	if len(data) < 1 || int(data[0]) != 2*int(quantity) || len(data) != 1+int(data[0]) {
+		return nil, fmt.Errorf("mbserver: bad response data %v", data)
+	}
+	return BytesToUint16(data[1:]), nil
+}
+
+// ReadCoils reads quantity coils of a unit from address (function 1).
+func (c *Client) ReadCoils(unit uint8, address, quantity uint16) ([]bool, error) {
+	return c.readBits(unit, 1, address, quantity)
+}
+
+// ReadDiscreteInputs reads quantity discrete inputs of a unit from address
+// (function 2).
+func (c *Client) ReadDiscreteInputs(unit uint8, address, quantity uint16) ([]bool, error) {
+	return c.readBits(unit, 2, address, quantity)
+}
+
+// ReadHoldingRegisters reads quantity holding registers of a unit from
+// address (function 3).
+func (c *Client) ReadHoldingRegisters(unit uint8, address, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(unit, 3, address, quantity)
+}
+
+// ReadInputRegisters reads quantity input registers of a unit from address
+// (function 4).
+func (c *Client) ReadInputRegisters(unit uint8, address, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(unit, 4, address, quantity)
+}
+
+// WriteSingleCoil writes a coil of a unit (function 5).
+func (c *Client) WriteSingleCoil(unit uint8, address uint16, value bool) error {
+	frame := &TCPFrame{Device: unit, Function: 5}
+	if value {
+		SetDataWithRegisterAndNumber(frame, address, coilOn)
+	} else {
+		SetDataWithRegisterAndNumber(frame, address, coilOff)
+	}
+	_, err := c.Send(frame)
+	return err
+}
+
+// WriteSingleRegister writes a holding register of a unit (function 6).
+func (c *Client) WriteSingleRegister(unit uint8, address, value uint16) error {
+	frame := &TCPFrame{Device: unit, Function: 6}
+	SetDataWithRegisterAndNumber(frame, address, value)
+	_, err := c.Send(frame)
+	return err
+}
+
+// WriteMultipleCoils writes coils of a unit from address (function 15).
+func (c *Client) WriteMultipleCoils(unit uint8, address uint16, values []bool) error {
+	frame := &TCPFrame{Device: unit, Function: 15}
+	SetDataWithRegisterAndNumberAndBytes(frame, address, uint16(len(values)), bitsToBytes(values)[1:])
+	_, err := c.Send(frame)
+	return err
+}
+
+// WriteMultipleRegisters writes holding registers of a unit from address
+// (function 16).
+func (c *Client) WriteMultipleRegisters(unit uint8, address uint16, values []uint16) error {
+	frame := &TCPFrame{Device: unit, Function: 16}
+	SetDataWithRegisterAndNumberAndValues(frame, address, uint16(len(values)), values)
+	_, err := c.Send(frame)
+	return err
+}
+
+// ReadWriteMultipleRegisters writes holding registers of a unit from
+// writeAddress and then reads readQuantity holding registers from
+// readAddress (function 23).
+func (c *Client) ReadWriteMultipleRegisters(unit uint8, readAddress, readQuantity, writeAddress uint16, values []uint16) ([]uint16, error) {
+	frame := &TCPFrame{Device: unit, Function: 23}
+	SetDataWithRegisterAndNumberAndValues(frame, writeAddress, uint16(len(values)), values)
+	read := make([]byte, 4, 4+len(frame.Data))
+	binary.BigEndian.PutUint16(read[0:2], readAddress)
+	binary.BigEndian.PutUint16(read[2:4], readQuantity)
+	frame.SetData(append(read, frame.Data...))
+	data, err := c.sendData(frame)
+	if err != nil {
+		return nil, err
+	}
+	return registerValues(data, readQuantity)
+}
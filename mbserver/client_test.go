@@ -0,0 +1,168 @@
+package mbserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	tcp := getFreePort()
+	if err := s.ListenTCP(tcp); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	rtu := getFreePort()
+	if err := s.ListenRTUTCP(rtu); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	dials := []struct {
+		name string
+		dial func(string) (*Client, error)
+		addr string
+	}{
+		{"tcp", DialTCP, tcp},
+		{"rtu-tcp", DialRTUTCP, rtu},
+	}
+	for _, d := range dials {
+		t.Run(d.name, func(t *testing.T) {
+			c, err := d.dial(d.addr)
+			if err != nil {
+				t.Fatalf("failed to connect, got %v\n", err)
+			}
+			defer c.Close()
+
+			if err := c.WriteMultipleRegisters(1, 10, []uint16{1, 2, 3}); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			if err := c.WriteSingleRegister(1, 13, 4); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			registers, err := c.ReadHoldingRegisters(1, 10, 4)
+			if err != nil || !isEqual([]uint16{1, 2, 3, 4}, registers) {
+				t.Errorf("expected %v, got %v %v", []uint16{1, 2, 3, 4}, registers, err)
+			}
+			// Return Query Data echoes any number of bytes.
+			query := &TCPFrame{Device: 1, Function: 8, Data: []byte{0, 0, 0xA5, 0x37, 0x42}}
+			if response, err := c.Send(query); err != nil || !isEqual(query.Data, response.GetData()) {
+				t.Errorf("expected %v, got %v %v", query.Data, response, err)
+			}
+			registers, err = c.ReadWriteMultipleRegisters(1, 12, 2, 10, []uint16{5, 6, 7})
+			if err != nil || !isEqual([]uint16{7, 4}, registers) {
+				t.Errorf("expected %v, got %v %v", []uint16{7, 4}, registers, err)
+			}
+
+			coils := []bool{true, false, true, true, false, false, false, false, true}
+			if err := c.WriteMultipleCoils(1, 20, coils); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			if err := c.WriteSingleCoil(1, 21, true); err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			coils[1] = true
+			got, err := c.ReadCoils(1, 20, uint16(len(coils)))
+			if err != nil || !isEqual(coils, got) {
+				t.Errorf("expected %v, got %v %v", coils, got, err)
+			}
+
+			s.WriteInput(3, []uint16{9})
+			s.WriteDiscrete(3, []bool{true})
+			registers, err = c.ReadInputRegisters(1, 3, 1)
+			if err != nil || !isEqual([]uint16{9}, registers) {
+				t.Errorf("expected %v, got %v %v", []uint16{9}, registers, err)
+			}
+			got, err = c.ReadDiscreteInputs(1, 3, 1)
+			if err != nil || !isEqual([]bool{true}, got) {
+				t.Errorf("expected %v, got %v %v", []bool{true}, got, err)
+			}
+
+			// Exceptions are returned as errors.
+			_, err = c.ReadHoldingRegisters(1, 65535, 2)
+			if err != IllegalDataAddress {
+				t.Errorf("expected %v, got %v", IllegalDataAddress, err)
+			}
+
+			// Requests can be built with the frame helpers.
+			frame := &RTUFrame{Address: 1, Function: 3}
+			SetDataWithRegisterAndNumber(frame, 10, 1)
+			response, err := c.Send(frame)
+			if err != nil || !isEqual([]byte{2, 0, 5}, response.GetData()) {
+				t.Errorf("expected %v, got %v %v", []byte{2, 0, 5}, response, err)
+			}
+		})
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		action  FaultAction
+		retries int
+		err     error
+	}{
+		{DropResponse, 0, ErrTimeout},
+		{DropResponse, 1, nil},
+		{CloseConnection, 1, nil},
+		{BusyResponse, 1, SlaveDeviceBusy},
+	}
+	for _, test := range tests {
+		// Each case has its own server, so that clearing the fault of one
+		// case cannot race with setting the fault of the next.
+		s := NewServer()
+		s.WriteHolding(0, []uint16{42})
+		s.SetFaults(Fault{Action: test.action, Probability: 1})
+		// Faults are cleared once they have been applied to one request.
+		s.Trace = func(TraceEvent) { s.SetFaults() }
+		addr := getFreePort()
+		if err := s.ListenTCP(addr); err != nil {
+			t.Fatalf("failed to listen, got %v\n", err)
+		}
+
+		c, err := DialTCP(addr)
+		if err != nil {
+			t.Fatalf("failed to connect, got %v\n", err)
+		}
+		c.Timeout = 200 * time.Millisecond
+		c.Retries = test.retries
+
+		registers, err := c.ReadHoldingRegisters(1, 0, 1)
+		if err != test.err {
+			t.Errorf("%v with %d retries: expected %v, got %v", test.action, test.retries, test.err, err)
+		}
+		if test.err == nil && !isEqual([]uint16{42}, registers) {
+			t.Errorf("expected %v, got %v", []uint16{42}, registers)
+		}
+
+		// The client recovers for the next request.
+		registers, err = c.ReadHoldingRegisters(1, 0, 1)
+		if err != nil || !isEqual([]uint16{42}, registers) {
+			t.Errorf("expected %v, got %v %v", []uint16{42}, registers, err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestRTUResponseLength(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		length int
+	}{
+		{[]byte{1}, 0},
+		{[]byte{1, 3}, 0},
+		{[]byte{1, 3, 4}, 9},
+		{[]byte{1, 0x83}, 5},
+		{[]byte{1, 6}, 8},
+		{[]byte{1, 16}, 8},
+		{[]byte{1, 8, 0, 0x0B}, 8},
+		{[]byte{1, 8, 0, 0}, -1},
+		{[]byte{1, 7}, 5},
+		{[]byte{1, 24, 0, 6}, 12},
+		{[]byte{1, 43}, -1},
+	}
+	for _, test := range tests {
+		if got := rtuResponseLength(test.packet); got != test.length {
+			t.Errorf("%v: expected %v, got %v", test.packet, test.length, got)
+		}
+	}
+}
@@ -41,12 +41,10 @@
 package main
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"os/signal"
 
@@ -207,17 +205,6 @@ type registerFile struct {
 	registerType registerType
 }
 
-// uint16ToLittleEndian will swap the byte order of the 'two
-// 8 bit bytes that an uint16 is made up of.
-func uint16ToLittleEndian(u uint16) uint16 {
-	fmt.Printf("before: %b\n", u)
-	b := make([]byte, 2)
-	binary.LittleEndian.PutUint16(b, u)
-	v := binary.BigEndian.Uint16(b)
-	fmt.Printf("after: %b\n", v)
-	return v
-}
-
 // uint16ToByteSlice will split a 16 bit value into two 8 bit
 // values, and return them as a slice if bytes.
 func uint16ToByteSlice(u uint16) []byte {
@@ -235,8 +222,7 @@ const discreteSize = 1
 const inputSize = 2
 const holdingSize = 2
 
-// setRegister will set the values into the register that is presented as a slice
-// within the serv receiver.
+// setRegister will set the values into the register of the serv receiver.
 func setRegister(serv *mbserver.Server, registryData []encoder, registerType string, addrOffset int) error {
 	var prevAddr int
 
@@ -250,7 +236,10 @@ func setRegister(serv *mbserver.Server, registryData []encoder, registerType str
 				return fmt.Errorf("wrong increment of address in coil register for address after %v", addr)
 			}
 
-			serv.Coils = append(serv.Coils[:addr], b...)
+			err := serv.WriteCoils(uint16(addr), []bool{b[0] != 0, b[1] != 0})
+			if err != nil {
+				return fmt.Errorf("failed to set coil register at address %v: %v", addr, err)
+			}
 			prevAddr = addr
 		}
 	case "discrete":
@@ -262,7 +251,10 @@ func setRegister(serv *mbserver.Server, registryData []encoder, registerType str
 				return fmt.Errorf("wrong increment of address in discrete register for address after %v", addr)
 			}
 
-			serv.DiscreteInputs = append(serv.DiscreteInputs[:addr], b...)
+			err := serv.WriteDiscrete(uint16(addr), []bool{b[0] != 0, b[1] != 0})
+			if err != nil {
+				return fmt.Errorf("failed to set discrete register at address %v: %v", addr, err)
+			}
 			prevAddr = addr
 		}
 	case "input":
@@ -273,7 +265,10 @@ func setRegister(serv *mbserver.Server, registryData []encoder, registerType str
 				return fmt.Errorf("wrong increment of address in input register for address after %v", addr)
 			}
 
-			serv.InputRegisters = append(serv.InputRegisters[:addr], v.Encode()...)
+			err := serv.WriteInput(uint16(addr), v.Encode())
+			if err != nil {
+				return fmt.Errorf("failed to set input register at address %v: %v", addr, err)
+			}
 			prevAddr = addr
 		}
 	case "holding":
@@ -284,7 +279,10 @@ func setRegister(serv *mbserver.Server, registryData []encoder, registerType str
 				return fmt.Errorf("wrong increment of address in holding register for address after %v", addr)
 			}
 
-			serv.HoldingRegisters = append(serv.HoldingRegisters[:addr], v.Encode()...)
+			err := serv.WriteHolding(uint16(addr), v.Encode())
+			if err != nil {
+				return fmt.Errorf("failed to set holding register at address %v: %v", addr, err)
+			}
 			prevAddr = addr
 		}
 	default:
@@ -313,11 +311,7 @@ type float32LittleWordBigEndian struct {
 //	- The two 16 bits word are little endian
 //	- The Byte order of each word a big endian
 func (f float32LittleWordBigEndian) Encode() []uint16 {
-	n := float32(f.Number)
-	v1 := uint16((math.Float32bits(n) >> 16) & 0xffff)
-	v2 := uint16((math.Float32bits(n)) & 0xffff)
-	// fmt.Printf("*v1 = %v*\n", v1)
-	return []uint16{v2, v1}
+	return mbserver.EncodeFloat32(float32(f.Number), mbserver.CDAB)
 }
 
 func (f float32LittleWordBigEndian) Address() int {
@@ -334,14 +328,10 @@ type float32BigWordBigEndian struct {
 }
 
 // encode will encode a float32 value into []uint16 where:
-//	- The two 16 bits word are little endian
+//	- The two 16 bits word are big endian
 //	- The Byte order of each word a big endian
 func (f float32BigWordBigEndian) Encode() []uint16 {
-	n := float32(f.Number)
-	v1 := uint16((math.Float32bits(n) >> 16) & 0xffff)
-	v2 := uint16((math.Float32bits(n)) & 0xffff)
-	// fmt.Printf("*v1 = %v*\n", v1)
-	return []uint16{v1, v2}
+	return mbserver.EncodeFloat32(float32(f.Number), mbserver.ABCD)
 }
 
 func (f float32BigWordBigEndian) Address() int {
@@ -359,16 +349,9 @@ type float32LittleWordLittleEndian struct {
 
 // encode will encode a float32 value into []uint16 where:
 //	- The two 16 bits word are little endian
-//	- The Byte order of each word a big endian
+//	- The Byte order of each word a little endian
 func (f float32LittleWordLittleEndian) Encode() []uint16 {
-	n := float32(f.Number)
-	v1 := uint16((math.Float32bits(n) >> 16) & 0xffff)
-	v2 := uint16((math.Float32bits(n)) & 0xffff)
-	// fmt.Printf("*v1 = %v*\n", v1)
-
-	v1 = uint16ToLittleEndian(v1)
-	v2 = uint16ToLittleEndian(v2)
-	return []uint16{v2, v1}
+	return mbserver.EncodeFloat32(float32(f.Number), mbserver.DCBA)
 }
 
 func (f float32LittleWordLittleEndian) Address() int {
@@ -385,17 +368,10 @@ type float32BigWordLittleEndian struct {
 }
 
 // encode will encode a float32 value into []uint16 where:
-//	- The two 16 bits word are little endian
-//	- The Byte order of each word a big endian
+//	- The two 16 bits word are big endian
+//	- The Byte order of each word a little endian
 func (f float32BigWordLittleEndian) Encode() []uint16 {
-	n := float32(f.Number)
-	v1 := uint16((math.Float32bits(n) >> 16) & 0xffff)
-	v2 := uint16((math.Float32bits(n)) & 0xffff)
-	// fmt.Printf("*v1 = %v*\n", v1)
-
-	v1 = uint16ToLittleEndian(v1)
-	v2 = uint16ToLittleEndian(v2)
-	return []uint16{v1, v2}
+	return mbserver.EncodeFloat32(float32(f.Number), mbserver.BADC)
 }
 
 func (f float32BigWordLittleEndian) Address() int {
@@ -442,10 +418,7 @@ type wordInt16LittleEndian struct {
 }
 
 func (w wordInt16LittleEndian) Encode() []uint16 {
-	v := uint16(w.Number)
-	v = uint16ToLittleEndian(v)
-
-	return []uint16{v}
+	return mbserver.EncodeUint16(uint16(w.Number), mbserver.DCBA)
 }
 
 func (f wordInt16LittleEndian) Address() int {
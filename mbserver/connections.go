@@ -0,0 +1,166 @@
+package mbserver
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// ClientLimitPolicy selects what happens when a master connects to a server
+// that already has MaxClients connections.
+type ClientLimitPolicy int
+
+const (
+	// RejectNewClients closes the new connection. This is the default.
+	RejectNewClients ClientLimitPolicy = iota
+	// EvictOldestClient closes the connection that was opened first to make
+	// room for the new one.
+	EvictOldestClient
+)
+
+// ConnectionInfo describes the connection of a master to one of the TCP
+// listeners.
+type ConnectionInfo struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	Connected  time.Time
+	// Requests is the number of requests received on the connection.
+	Requests uint64
+	// LastActivity is when the last request was received or answered, or
+	// when the master connected.
+	LastActivity time.Time
+}
+
+// connection is an accepted client connection and its accounting, guarded
+// by the server's lifeMu. pending counts the requests received but not yet
+// answered.
+type connection struct {
+	conn         net.Conn
+	connected    time.Time
+	requests     uint64
+	pending      int
+	lastActivity time.Time
+	idleTimer    *time.Timer
+}
+
+// Connections returns the connections of masters to the TCP, RTU over TCP,
+// ASCII over TCP and Modbus/TCP Security listeners, oldest first.
+func (s *Server) Connections() []ConnectionInfo {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+
+	connections := make([]ConnectionInfo, 0, len(s.conns))
+	for _, c := range s.conns {
+		connections = append(connections, ConnectionInfo{
+			RemoteAddr:   c.conn.RemoteAddr(),
+			LocalAddr:    c.conn.LocalAddr(),
+			Connected:    c.connected,
+			Requests:     c.requests,
+			LastActivity: c.lastActivity,
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Connected.Before(connections[j].Connected)
+	})
+	return connections
+}
+
+// admitConn adds an accepted connection to the server's connections,
+// applying MaxClients. It returns nil if the connection is rejected. The
+// caller holds lifeMu.
+func (s *Server) admitConn(conn net.Conn) *connection {
+	if s.MaxClients > 0 && len(s.conns) >= s.MaxClients {
+		if s.ClientLimit != EvictOldestClient {
+			s.logf("rejected connection from %v: %d clients connected\n", conn.RemoteAddr(), len(s.conns))
+			return nil
+		}
+		var oldest *connection
+		for _, c := range s.conns {
+			if oldest == nil || c.connected.Before(oldest.connected) {
+				oldest = c
+			}
+		}
+		s.logf("evicted connection from %v for %v\n", oldest.conn.RemoteAddr(), conn.RemoteAddr())
+		s.removeConn(oldest.conn)
+		oldest.conn.Close()
+	}
+
+	now := time.Now()
+	c := &connection{conn: conn, connected: now, lastActivity: now}
+	if s.IdleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(s.IdleTimeout, func() { s.closeIfIdle(c) })
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*connection)
+	}
+	s.conns[conn] = c
+	return c
+}
+
+// removeConn removes a connection from the server's connections. The caller
+// holds lifeMu.
+func (s *Server) removeConn(conn net.Conn) {
+	if c, ok := s.conns[conn]; ok {
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		delete(s.conns, conn)
+		s.captureClosed(conn)
+	}
+}
+
+// closeIfIdle closes a connection that has not received or answered a
+// request for IdleTimeout, or checks it again when it could next become
+// idle. Connections waiting for a response are never idle.
+func (s *Server) closeIfIdle(c *connection) {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if _, ok := s.conns[c.conn]; !ok {
+		return
+	}
+	if c.pending > 0 {
+		c.idleTimer.Reset(s.IdleTimeout)
+		return
+	}
+	if idle := time.Since(c.lastActivity); idle < s.IdleTimeout {
+		c.idleTimer.Reset(s.IdleTimeout - idle)
+		return
+	}
+	s.logf("closed idle connection from %v\n", c.conn.RemoteAddr())
+	s.removeConn(c.conn)
+	c.conn.Close()
+}
+
+// requestConn returns the accepted connection a request arrived on, or nil.
+// The caller holds lifeMu.
+func (s *Server) requestConn(request *Request) *connection {
+	conn, ok := request.conn.(net.Conn)
+	if !ok {
+		return nil
+	}
+	if secure, ok := conn.(*secureConn); ok {
+		conn = secure.Conn
+	}
+	return s.conns[conn]
+}
+
+// countRequest records a request received on an accepted connection. The
+// caller holds lifeMu.
+func (s *Server) countRequest(request *Request) {
+	if c := s.requestConn(request); c != nil {
+		c.requests++
+		c.pending++
+		c.lastActivity = time.Now()
+	}
+}
+
+// countResponse records that a request received on an accepted connection
+// has been answered, or handled without a response.
+func (s *Server) countResponse(request *Request) {
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if c := s.requestConn(request); c != nil {
+		c.pending--
+		c.lastActivity = time.Now()
+	}
+}
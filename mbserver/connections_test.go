@@ -0,0 +1,158 @@
+package mbserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectAndRead connects to addr and sends n Read Holding Registers
+// requests, reading their responses.
+func connectAndRead(t *testing.T, addr string, n int) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < n; i++ {
+		frame := &TCPFrame{TransactionIdentifier: uint16(i), Device: 1, Function: 3}
+		SetDataWithRegisterAndNumber(frame, 0, 1)
+		if _, err := conn.Write(frame.Bytes()); err != nil {
+			t.Fatalf("failed to write, got %v\n", err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 11)); err != nil {
+			t.Fatalf("failed to read response, got %v\n", err)
+		}
+	}
+	return conn
+}
+
+// expectClosed checks that the server has closed conn.
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	first := connectAndRead(t, addr, 2)
+	defer first.Close()
+	second := connectAndRead(t, addr, 1)
+	defer second.Close()
+
+	connections := s.Connections()
+	if len(connections) != 2 {
+		t.Fatalf("expected 2 connections, got %+v", connections)
+	}
+	if connections[0].RemoteAddr.String() != first.LocalAddr().String() || connections[0].Requests != 2 {
+		t.Errorf("expected %v with 2 requests, got %+v", first.LocalAddr(), connections[0])
+	}
+	if connections[1].Requests != 1 || !connections[1].LastActivity.After(connections[1].Connected) {
+		t.Errorf("expected 1 request after connecting, got %+v", connections[1])
+	}
+
+	first.Close()
+	time.Sleep(10 * time.Millisecond)
+	if connections := s.Connections(); len(connections) != 1 {
+		t.Errorf("expected 1 connection, got %+v", connections)
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.MaxClients = 1
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	first := connectAndRead(t, addr, 1)
+	defer first.Close()
+	rejected, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer rejected.Close()
+	expectClosed(t, rejected)
+
+	// A master can connect once the first one is gone.
+	first.Close()
+	time.Sleep(10 * time.Millisecond)
+	connectAndRead(t, addr, 1).Close()
+}
+
+func TestMaxClientsEvictOldest(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.MaxClients = 1
+	s.ClientLimit = EvictOldestClient
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	first := connectAndRead(t, addr, 1)
+	defer first.Close()
+	second := connectAndRead(t, addr, 1)
+	defer second.Close()
+	expectClosed(t, first)
+	if connections := s.Connections(); len(connections) != 1 || connections[0].RemoteAddr.String() != second.LocalAddr().String() {
+		t.Errorf("expected only %v, got %+v", second.LocalAddr(), connections)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.IdleTimeout = 200 * time.Millisecond
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	conn := connectAndRead(t, addr, 0)
+	defer conn.Close()
+	// Requests keep the connection open.
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		frame := &TCPFrame{Device: 1, Function: 3}
+		SetDataWithRegisterAndNumber(frame, 0, 1)
+		conn.Write(frame.Bytes())
+		if _, err := io.ReadFull(conn, make([]byte, 11)); err != nil {
+			t.Fatalf("failed to read response, got %v\n", err)
+		}
+	}
+	start := time.Now()
+	expectClosed(t, conn)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected the connection to be closed after 200ms idle, got %v", elapsed)
+	}
+}
+
+func TestIdleTimeoutSlowResponse(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.IdleTimeout = 50 * time.Millisecond
+	s.SetFaults(Fault{Action: DelayResponse, Delay: 200 * time.Millisecond, Probability: 1})
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	// The connection is not idle while the response is delayed.
+	conn := connectAndRead(t, addr, 1)
+	defer conn.Close()
+	expectClosed(t, conn)
+}
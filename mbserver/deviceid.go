@@ -0,0 +1,155 @@
+package mbserver
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Device identification object IDs used by function 43 / MEI type 14.
+// Objects 0x07 to 0x7F are reserved, 0x80 to 0xFF are extended objects
+// defined by the device.
+const (
+	VendorName          uint8 = 0x00
+	ProductCode         uint8 = 0x01
+	MajorMinorRevision  uint8 = 0x02
+	VendorURL           uint8 = 0x03
+	ProductName         uint8 = 0x04
+	ModelName           uint8 = 0x05
+	UserApplicationName uint8 = 0x06
+)
+
+// Read device ID codes of a Read Device Identification request.
+const (
+	readDeviceIDBasic      = 1
+	readDeviceIDRegular    = 2
+	readDeviceIDExtended   = 3
+	readDeviceIDIndividual = 4
+)
+
+// meiReadDeviceIdentification is the MEI type of Read Device Identification.
+const meiReadDeviceIdentification = 0x0E
+
+// deviceIDMaxObjectsLength is the space left for objects in a response PDU
+// after the function code and the 6 byte Read Device Identification header.
+const deviceIDMaxObjectsLength = 253 - 7
+
+// SetDeviceIdentification sets the value of a device identification object
+// returned by Read Device Identification (function 43 / MEI type 14).
+// Objects up to UserApplicationName are basic and regular objects, objects
+// from 0x80 are extended objects.
+func (s *Server) SetDeviceIdentification(objectID uint8, value string) error {
+	if objectID > UserApplicationName && objectID < 0x80 {
+		return fmt.Errorf("device identification object 0x%02x is reserved", objectID)
+	}
+	// An object must fit in a response on its own.
+	if len(value) > deviceIDMaxObjectsLength-2 {
+		return fmt.Errorf("device identification object 0x%02x is longer than %d bytes", objectID, deviceIDMaxObjectsLength-2)
+	}
+
+	s.deviceIDMu.Lock()
+	defer s.deviceIDMu.Unlock()
+	if s.deviceID == nil {
+		s.deviceID = make(map[uint8]string)
+	}
+	s.deviceID[objectID] = value
+	return nil
+}
+
+// DeviceIdentification returns the value of a device identification object
+// and whether it has been set.
+func (s *Server) DeviceIdentification(objectID uint8) (string, bool) {
+	s.deviceIDMu.RLock()
+	defer s.deviceIDMu.RUnlock()
+	value, ok := s.deviceID[objectID]
+	return value, ok
+}
+
+// deviceIDObjects returns the IDs of the objects in the categories up to and
+// including readDeviceID, in ascending order. The basic objects are
+// mandatory and always included.
+func (s *Server) deviceIDObjects(readDeviceID uint8) []uint8 {
+	s.deviceIDMu.RLock()
+	defer s.deviceIDMu.RUnlock()
+
+	ids := []uint8{VendorName, ProductCode, MajorMinorRevision}
+	for id := range s.deviceID {
+		switch {
+		case id <= MajorMinorRevision:
+		case id < 0x80 && readDeviceID >= readDeviceIDRegular:
+			ids = append(ids, id)
+		case id >= 0x80 && readDeviceID >= readDeviceIDExtended:
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// deviceIDConformityLevel returns the highest category of objects set, with
+// the flag for individual access which is always supported.
+func (s *Server) deviceIDConformityLevel() uint8 {
+	s.deviceIDMu.RLock()
+	defer s.deviceIDMu.RUnlock()
+
+	level := uint8(readDeviceIDBasic)
+	for id := range s.deviceID {
+		switch {
+		case id >= 0x80:
+			level = readDeviceIDExtended
+		case id > MajorMinorRevision && level < readDeviceIDRegular:
+			level = readDeviceIDRegular
+		}
+	}
+	return 0x80 | level
+}
+
+// ReadDeviceIdentification function 43 / MEI type 14, reads the device
+// identification objects. Stream access responses that do not fit in one PDU
+// are split, with "more follows" set and the next object ID to ask for.
+func ReadDeviceIdentification(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) < 1 || data[0] != meiReadDeviceIdentification {
+		return []byte{}, &IllegalFunction
+	}
+	if len(data) != 3 {
+		return []byte{}, &IllegalDataValue
+	}
+	readDeviceID := data[1]
+	objectID := data[2]
+
+	var ids []uint8
+	switch readDeviceID {
+	case readDeviceIDBasic, readDeviceIDRegular, readDeviceIDExtended:
+		ids = s.deviceIDObjects(readDeviceID)
+		// An unknown object ID restarts the stream at the first object.
+		start := sort.Search(len(ids), func(i int) bool { return ids[i] >= objectID })
+		if start == len(ids) || ids[start] != objectID {
+			start = 0
+		}
+		ids = ids[start:]
+	case readDeviceIDIndividual:
+		if _, ok := s.DeviceIdentification(objectID); !ok && objectID > MajorMinorRevision {
+			return []byte{}, &IllegalDataAddress
+		}
+		ids = []uint8{objectID}
+	default:
+		return []byte{}, &IllegalDataValue
+	}
+
+	response := []byte{meiReadDeviceIdentification, readDeviceID, s.deviceIDConformityLevel(), 0x00, 0x00, 0x00}
+	var objects []byte
+	for i, id := range ids {
+		value, _ := s.DeviceIdentification(id)
+		if len(objects)+2+len(value) > deviceIDMaxObjectsLength {
+			// More follows, starting with this object.
+			response[3] = 0xFF
+			response[4] = id
+			break
+		}
+		objects = append(objects, id, byte(len(value)))
+		objects = append(objects, value...)
+		response[5] = byte(i + 1)
+	}
+
+	return append(response, objects...), &Success
+}
@@ -0,0 +1,103 @@
+package mbserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadDeviceIdentificationBasic(t *testing.T) {
+	s := NewServer()
+	s.SetDeviceIdentification(VendorName, "Raa")
+	s.SetDeviceIdentification(ProductCode, "SIM")
+	s.SetDeviceIdentification(MajorMinorRevision, "V1.0")
+	s.SetDeviceIdentification(ModelName, "Pump")
+
+	response := handleRequest(s, 43, []byte{0x0E, 1, 0})
+	exception := GetException(response)
+	if exception != Success {
+		t.Fatalf("expected Success, got %v", exception.String())
+	}
+	expect := []byte{0x0E, 1, 0x82, 0, 0, 3,
+		0, 3, 'R', 'a', 'a',
+		1, 3, 'S', 'I', 'M',
+		2, 4, 'V', '1', '.', '0'}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestReadDeviceIdentificationRegular(t *testing.T) {
+	s := NewServer()
+	s.SetDeviceIdentification(ModelName, "Pump")
+	s.SetDeviceIdentification(0x80, "extended")
+
+	// Stream access starting at ModelName.
+	response := handleRequest(s, 43, []byte{0x0E, 2, ModelName})
+	expect := []byte{0x0E, 2, 0x83, 0, 0, 1, 5, 4, 'P', 'u', 'm', 'p'}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// An unknown object ID restarts at the first object.
+	response = handleRequest(s, 43, []byte{0x0E, 2, UserApplicationName})
+	expect = []byte{0x0E, 2, 0x83, 0, 0, 4, 0, 0, 1, 0, 2, 0, 5, 4, 'P', 'u', 'm', 'p'}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestReadDeviceIdentificationMoreFollows(t *testing.T) {
+	s := NewServer()
+	s.SetDeviceIdentification(0x80, strings.Repeat("a", 200))
+	s.SetDeviceIdentification(0x81, strings.Repeat("b", 200))
+
+	response := handleRequest(s, 43, []byte{0x0E, 3, 0})
+	got := response.GetData()
+	if got[3] != 0xFF || got[4] != 0x81 || got[5] != 4 {
+		t.Errorf("expected more follows from 0x81 after 4 objects, got %v", got[:6])
+	}
+
+	response = handleRequest(s, 43, []byte{0x0E, 3, 0x81})
+	got = response.GetData()
+	if got[3] != 0 || got[5] != 1 || got[6] != 0x81 {
+		t.Errorf("expected the last object 0x81, got %v", got[:7])
+	}
+}
+
+func TestReadDeviceIdentificationIndividual(t *testing.T) {
+	s := NewServer()
+	s.SetDeviceIdentification(0x90, "serial 42")
+
+	response := handleRequest(s, 43, []byte{0x0E, 4, 0x90})
+	expect := []byte{0x0E, 4, 0x83, 0, 0, 1, 0x90, 9, 's', 'e', 'r', 'i', 'a', 'l', ' ', '4', '2'}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	response = handleRequest(s, 43, []byte{0x0E, 4, 0x91})
+	exception := GetException(response)
+	if exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+}
+
+func TestReadDeviceIdentificationInvalid(t *testing.T) {
+	s := NewServer()
+
+	response := handleRequest(s, 43, []byte{0x0E, 5, 0})
+	exception := GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+
+	if err := s.SetDeviceIdentification(0x10, "reserved"); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if err := s.SetDeviceIdentification(0x80, strings.Repeat("a", 245)); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
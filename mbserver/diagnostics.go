@@ -0,0 +1,363 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Diagnostics are the serial line diagnostic counters of a server, as
+// returned by the Diagnostics (function 8) sub-functions. Bus counters are
+// shared by a server and its units, the slave counters are kept per unit.
+type Diagnostics struct {
+	BusMessageCount            uint16
+	BusCommunicationErrorCount uint16
+	BusCharacterOverrunCount   uint16
+	SlaveExceptionErrorCount   uint16
+	SlaveMessageCount          uint16
+	SlaveNoResponseCount       uint16
+	SlaveNAKCount              uint16
+	SlaveBusyCount             uint16
+}
+
+// Diagnostics sub-function codes.
+const (
+	diagReturnQueryData                    = 0x00
+	diagRestartCommunicationsOption        = 0x01
+	diagReturnDiagnosticRegister           = 0x02
+	diagChangeASCIIInputDelimiter          = 0x03
+	diagForceListenOnlyMode                = 0x04
+	diagClearCountersAndDiagnosticRegister = 0x0A
+	diagReturnBusMessageCount              = 0x0B
+	diagReturnBusCommunicationErrorCount   = 0x0C
+	diagReturnBusExceptionErrorCount       = 0x0D
+	diagReturnSlaveMessageCount            = 0x0E
+	diagReturnSlaveNoResponseCount         = 0x0F
+	diagReturnSlaveNAKCount                = 0x10
+	diagReturnSlaveBusyCount               = 0x11
+	diagReturnBusCharacterOverrunCount     = 0x12
+	diagClearOverrunCounterAndFlag         = 0x14
+)
+
+// Communication event log entries and flags.
+const (
+	eventCommunicationRestart = 0x00
+	eventEnteredListenOnly    = 0x04
+	eventReceive              = 0x80
+	eventReceiveListenOnly    = 0x20
+	eventSend                 = 0x40
+	eventSendReadException    = 0x01
+	eventSendSlaveAbort       = 0x02
+	eventSendSlaveBusy        = 0x04
+	eventSendSlaveNAK         = 0x08
+	eventSendListenOnly       = 0x20
+	eventLogLength            = 64
+)
+
+// diagnostics holds the counters, communication event log and serial line
+// state of a server. restarting is set while a restart communications request
+// received in listen only mode is processed, as it is not answered.
+type diagnostics struct {
+	mu sync.Mutex
+	Diagnostics
+	register        uint16
+	exceptionStatus uint8
+	asciiDelimiter  byte
+	listenOnly      bool
+	restarting      bool
+	eventCount      uint16
+	events          []byte
+}
+
+func newDiagnostics() *diagnostics {
+	return &diagnostics{asciiDelimiter: '\n'}
+}
+
+// logEvent adds an event to the front of the communication event log.
+func (d *diagnostics) logEvent(event byte) {
+	d.events = append([]byte{event}, d.events...)
+	if len(d.events) > eventLogLength {
+		d.events = d.events[:eventLogLength]
+	}
+}
+
+// clear resets the counters and the diagnostic register.
+func (d *diagnostics) clear() {
+	d.Diagnostics = Diagnostics{}
+	d.register = 0
+}
+
+// countBusMessage counts a message seen on the bus.
+func (d *diagnostics) countBusMessage() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.BusMessageCount++
+}
+
+// countCommunicationError counts a message with a bad CRC or LRC.
+func (d *diagnostics) countCommunicationError() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.BusCommunicationErrorCount++
+}
+
+// countNoResponse counts a processed request that is not answered, such as a
+// broadcast.
+func (d *diagnostics) countNoResponse() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.restarting = false
+	d.SlaveNoResponseCount++
+}
+
+// receive records a request addressed to the server and reports whether it
+// should be processed. In listen only mode only a restart communications
+// request is processed.
+func (d *diagnostics) receive(frame Framer) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.SlaveMessageCount++
+	if !d.listenOnly {
+		d.logEvent(eventReceive)
+		return true
+	}
+	d.logEvent(eventReceive | eventReceiveListenOnly)
+
+	data := frame.GetData()
+	if frame.GetFunction() == 8 && len(data) >= 2 && binary.BigEndian.Uint16(data[0:2]) == diagRestartCommunicationsOption {
+		d.restarting = true
+		return true
+	}
+	d.SlaveNoResponseCount++
+	return false
+}
+
+// send records the outcome of a processed request and reports whether a
+// response should be sent.
+func (d *diagnostics) send(function uint8, exception *Exception) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	restarting := d.restarting
+	d.restarting = false
+	if d.listenOnly {
+		d.SlaveNoResponseCount++
+		return false
+	}
+	if restarting {
+		// Listen only mode ends without a response to the restart.
+		return false
+	}
+
+	event := byte(eventSend)
+	switch *exception {
+	case Success:
+		// Fetching the event counter or log does not count as an event.
+		if function != 11 && function != 12 {
+			d.eventCount++
+		}
+	case IllegalFunction, IllegalDataAddress, IllegalDataValue:
+		event |= eventSendReadException
+	case SlaveDeviceFailure:
+		event |= eventSendSlaveAbort
+	case AcknowledgeSlave, SlaveDeviceBusy:
+		event |= eventSendSlaveBusy
+		if *exception == SlaveDeviceBusy {
+			d.SlaveBusyCount++
+		}
+	case NegativeAcknowledge:
+		event |= eventSendSlaveNAK
+		d.SlaveNAKCount++
+	}
+	if *exception != Success {
+		d.SlaveExceptionErrorCount++
+	}
+	d.logEvent(event)
+	return true
+}
+
+// Diagnostics returns the diagnostic counters of the server.
+func (s *Server) Diagnostics() Diagnostics {
+	s.bus.mu.Lock()
+	bus := s.bus.Diagnostics
+	s.bus.mu.Unlock()
+
+	s.diag.mu.Lock()
+	defer s.diag.mu.Unlock()
+	diagnostics := s.diag.Diagnostics
+	diagnostics.BusMessageCount = bus.BusMessageCount
+	diagnostics.BusCommunicationErrorCount = bus.BusCommunicationErrorCount
+	diagnostics.BusCharacterOverrunCount = bus.BusCharacterOverrunCount
+	return diagnostics
+}
+
+// ClearDiagnostics resets the diagnostic counters and register of the server
+// and its bus.
+func (s *Server) ClearDiagnostics() {
+	for _, d := range []*diagnostics{s.bus, s.diag} {
+		d.mu.Lock()
+		d.clear()
+		d.mu.Unlock()
+	}
+}
+
+// SetDiagnosticRegister sets the value returned by the Return Diagnostic
+// Register sub-function.
+func (s *Server) SetDiagnosticRegister(value uint16) {
+	s.diag.mu.Lock()
+	defer s.diag.mu.Unlock()
+	s.diag.register = value
+}
+
+// SetExceptionStatus sets the eight exception status outputs returned by
+// Read Exception Status (function 7).
+func (s *Server) SetExceptionStatus(status uint8) {
+	s.diag.mu.Lock()
+	defer s.diag.mu.Unlock()
+	s.diag.exceptionStatus = status
+}
+
+// asciiDelimiter returns the character that ends Modbus ASCII frames. It is
+// kept with the bus counters, as a change sent to any unit applies to the
+// line.
+func (s *Server) asciiDelimiter() byte {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.bus.asciiDelimiter
+}
+
+// ReadExceptionStatus function 7, reads the exception status outputs.
+func ReadExceptionStatus(s *Server, frame Framer) ([]byte, *Exception) {
+	if len(frame.GetData()) != 0 {
+		return []byte{}, &IllegalDataValue
+	}
+	s.diag.mu.Lock()
+	defer s.diag.mu.Unlock()
+	return []byte{s.diag.exceptionStatus}, &Success
+}
+
+// Diagnostic function 8, returns the serial line diagnostic counters and
+// controls the communication state of the server.
+func Diagnostic(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) < 2 {
+		return []byte{}, &IllegalDataValue
+	}
+	subFunction := binary.BigEndian.Uint16(data[0:2])
+
+	// Return Query Data echoes data of any length.
+	if subFunction == diagReturnQueryData {
+		return data, &Success
+	}
+	if len(data) != 4 {
+		return []byte{}, &IllegalDataValue
+	}
+	value := binary.BigEndian.Uint16(data[2:4])
+
+	d := s.diag
+	bus := s.bus
+	counter := func(c *uint16) ([]byte, *Exception) {
+		if value != 0 {
+			return []byte{}, &IllegalDataValue
+		}
+		return []byte{data[0], data[1], byte(*c >> 8), byte(*c)}, &Success
+	}
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if d != bus {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+	}
+
+	switch subFunction {
+	case diagRestartCommunicationsOption:
+		if value != 0x0000 && value != 0xFF00 {
+			return []byte{}, &IllegalDataValue
+		}
+		if value == 0xFF00 {
+			d.events = nil
+		}
+		d.clear()
+		bus.clear()
+		d.listenOnly = false
+		d.logEvent(eventCommunicationRestart)
+		return data, &Success
+	case diagReturnDiagnosticRegister:
+		return counter(&d.register)
+	case diagChangeASCIIInputDelimiter:
+		if data[3] != 0 {
+			return []byte{}, &IllegalDataValue
+		}
+		bus.asciiDelimiter = data[2]
+		return data, &Success
+	case diagForceListenOnlyMode:
+		if value != 0 {
+			return []byte{}, &IllegalDataValue
+		}
+		d.listenOnly = true
+		d.logEvent(eventEnteredListenOnly)
+		return data, &Success
+	case diagClearCountersAndDiagnosticRegister:
+		if value != 0 {
+			return []byte{}, &IllegalDataValue
+		}
+		d.clear()
+		bus.clear()
+		return data, &Success
+	case diagReturnBusMessageCount:
+		return counter(&bus.BusMessageCount)
+	case diagReturnBusCommunicationErrorCount:
+		return counter(&bus.BusCommunicationErrorCount)
+	case diagReturnBusExceptionErrorCount:
+		return counter(&d.SlaveExceptionErrorCount)
+	case diagReturnSlaveMessageCount:
+		return counter(&d.SlaveMessageCount)
+	case diagReturnSlaveNoResponseCount:
+		return counter(&d.SlaveNoResponseCount)
+	case diagReturnSlaveNAKCount:
+		return counter(&d.SlaveNAKCount)
+	case diagReturnSlaveBusyCount:
+		return counter(&d.SlaveBusyCount)
+	case diagReturnBusCharacterOverrunCount:
+		return counter(&bus.BusCharacterOverrunCount)
+	case diagClearOverrunCounterAndFlag:
+		if value != 0 {
+			return []byte{}, &IllegalDataValue
+		}
+		bus.BusCharacterOverrunCount = 0
+		return data, &Success
+	}
+	return []byte{}, &IllegalFunction
+}
+
+// GetCommEventCounter function 11, returns the status word and the count of
+// successfully completed requests.
+func GetCommEventCounter(s *Server, frame Framer) ([]byte, *Exception) {
+	if len(frame.GetData()) != 0 {
+		return []byte{}, &IllegalDataValue
+	}
+	s.diag.mu.Lock()
+	defer s.diag.mu.Unlock()
+	// The status word is 0xFFFF only while a program command is in progress.
+	return []byte{0, 0, byte(s.diag.eventCount >> 8), byte(s.diag.eventCount)}, &Success
+}
+
+// GetCommEventLog function 12, returns the status word, event count, bus
+// message count and the communication event log, most recent event first.
+func GetCommEventLog(s *Server, frame Framer) ([]byte, *Exception) {
+	if len(frame.GetData()) != 0 {
+		return []byte{}, &IllegalDataValue
+	}
+	s.bus.mu.Lock()
+	messageCount := s.bus.BusMessageCount
+	s.bus.mu.Unlock()
+
+	s.diag.mu.Lock()
+	defer s.diag.mu.Unlock()
+	data := make([]byte, 7, 7+len(s.diag.events))
+	data[0] = byte(6 + len(s.diag.events))
+	binary.BigEndian.PutUint16(data[3:5], s.diag.eventCount)
+	binary.BigEndian.PutUint16(data[5:7], messageCount)
+	return append(data, s.diag.events...), &Success
+}
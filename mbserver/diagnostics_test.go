@@ -0,0 +1,192 @@
+package mbserver
+
+import (
+	"testing"
+)
+
+func TestDiagnosticCounters(t *testing.T) {
+	s := NewServer()
+
+	// A good request and one answered with an exception.
+	handleRequest(s, 3, []byte{0, 0, 0, 1})
+	handleRequest(s, 100, nil)
+
+	tests := []struct {
+		subFunction byte
+		expect      []byte
+	}{
+		{diagReturnBusMessageCount, []byte{0, 0x0B, 0, 3}},
+		{diagReturnBusExceptionErrorCount, []byte{0, 0x0D, 0, 1}},
+		{diagReturnSlaveMessageCount, []byte{0, 0x0E, 0, 5}},
+		{diagReturnSlaveNoResponseCount, []byte{0, 0x0F, 0, 0}},
+	}
+	for _, test := range tests {
+		response := handleRequest(s, 8, []byte{0, test.subFunction, 0, 0})
+		exception := GetException(response)
+		if exception != Success {
+			t.Fatalf("expected Success, got %v", exception.String())
+		}
+		got := response.GetData()
+		if !isEqual(test.expect, got) {
+			t.Errorf("expected %v, got %v", test.expect, got)
+		}
+	}
+
+	expect := Diagnostics{
+		BusMessageCount:          6,
+		SlaveExceptionErrorCount: 1,
+		SlaveMessageCount:        6,
+	}
+	got := s.Diagnostics()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %+v, got %+v", expect, got)
+	}
+
+	handleRequest(s, 8, []byte{0, diagClearCountersAndDiagnosticRegister, 0, 0})
+	expect = Diagnostics{}
+	got = s.Diagnostics()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %+v, got %+v", expect, got)
+	}
+}
+
+func TestDiagnosticReturnQueryData(t *testing.T) {
+	s := NewServer()
+	response := handleRequest(s, 8, []byte{0, 0, 0xA5, 0x37, 0x42})
+	expect := []byte{0, 0, 0xA5, 0x37, 0x42}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	response = handleRequest(s, 8, []byte{0, 0x63, 0, 0})
+	exception := GetException(response)
+	if exception != IllegalFunction {
+		t.Errorf("expected IllegalFunction, got %v", exception.String())
+	}
+}
+
+func TestDiagnosticListenOnly(t *testing.T) {
+	s := NewServer()
+
+	response := handleRequest(s, 8, []byte{0, diagForceListenOnlyMode, 0, 0})
+	if response != nil {
+		t.Fatalf("expected no response, got %v", response.Bytes())
+	}
+	response = handleRequest(s, 3, []byte{0, 0, 0, 1})
+	if response != nil {
+		t.Fatalf("expected no response, got %v", response.Bytes())
+	}
+	got := s.Diagnostics().SlaveNoResponseCount
+	if got != 2 {
+		t.Errorf("expected %v, got %v", 2, got)
+	}
+
+	// Restart communications ends listen only mode and clears the counters,
+	// without a response.
+	response = handleRequest(s, 8, []byte{0, diagRestartCommunicationsOption, 0, 0})
+	if response != nil {
+		t.Fatalf("expected no response, got %v", response.Bytes())
+	}
+	response = handleRequest(s, 3, []byte{0, 0, 0, 1})
+	if response == nil {
+		t.Fatalf("expected a response, got nil")
+	}
+	// Out of listen only mode a restart is answered.
+	response = handleRequest(s, 8, []byte{0, diagRestartCommunicationsOption, 0, 0})
+	if response == nil {
+		t.Fatalf("expected a response, got nil")
+	}
+}
+
+func TestReadExceptionStatus(t *testing.T) {
+	s := NewServer()
+	s.SetExceptionStatus(0x6D)
+
+	response := handleRequest(s, 7, nil)
+	expect := []byte{0x6D}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestCommEventCounterAndLog(t *testing.T) {
+	s := NewServer()
+
+	handleRequest(s, 3, []byte{0, 0, 0, 1})
+	handleRequest(s, 3, []byte{0, 0, 0, 1})
+	handleRequest(s, 100, nil)
+
+	// Exceptions and the fetch itself are not counted as events.
+	response := handleRequest(s, 11, nil)
+	expect := []byte{0, 0, 0, 2}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	response = handleRequest(s, 12, nil)
+	expect = []byte{15, 0, 0, 0, 2, 0, 5,
+		0x80,       // Get Comm Event Log
+		0x40, 0x80, // Get Comm Event Counter
+		0x41, 0x80, // Exception
+		0x40, 0x80, // Read holding registers
+		0x40, 0x80}
+	got = response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestUnitDiagnostics(t *testing.T) {
+	s := NewServer()
+	unit := s.AddUnit(2)
+
+	handleRequest(s, 3, []byte{0, 0, 0, 1})
+	var req Request
+	req.frame = &RTUFrame{Address: 2, Function: 3, Data: []byte{0, 0, 0, 1}}
+	s.handle(&req)
+
+	// The bus counters are shared, the slave counters are not.
+	expect := Diagnostics{BusMessageCount: 2, SlaveMessageCount: 1}
+	got := unit.Diagnostics()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %+v, got %+v", expect, got)
+	}
+}
+
+func TestDiagnosticsOverTCP(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetExceptionStatus(0x6D)
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	c, err := DialTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer c.Close()
+
+	// Read Exception Status, Get Comm Event Counter and Get Comm Event Log
+	// requests are 8 byte ADUs without data.
+	tests := []struct {
+		function uint8
+		expect   []byte
+	}{
+		{7, []byte{0x6D}},
+		{11, []byte{0, 0, 0, 1}},
+		{12, []byte{11, 0, 0, 0, 1, 0, 3, 0x80, 0x40, 0x80, 0x40, 0x80}},
+	}
+	for _, test := range tests {
+		response, err := c.Send(&TCPFrame{Device: 1, Function: test.function})
+		if err != nil {
+			t.Fatalf("function %v: expected nil, got %v", test.function, err)
+		}
+		if got := response.GetData(); !isEqual(test.expect, got) {
+			t.Errorf("function %v: expected %v, got %v", test.function, test.expect, got)
+		}
+	}
+}
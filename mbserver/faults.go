@@ -0,0 +1,233 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// FaultAction is what an injected fault does to a response.
+type FaultAction int
+
+const (
+	// DelayResponse sends the response after the fault's Delay. The server
+	// handles one request at a time, so other masters wait too, as they would
+	// on a slow device.
+	DelayResponse FaultAction = iota + 1
+	// DropResponse executes the request but sends no response.
+	DropResponse
+	// BusyResponse answers SlaveDeviceBusy without executing the request.
+	BusyResponse
+	// FailureResponse answers SlaveDeviceFailure without executing the
+	// request.
+	FailureResponse
+	// CorruptResponse executes the request and sends the response with a bad
+	// CRC (RTU), a bad LRC (ASCII) or a wrong MBAP length (Modbus TCP).
+	CorruptResponse
+	// CloseConnection executes the request and closes the network connection
+	// instead of responding. On serial lines the response is dropped.
+	CloseConnection
+)
+
+func (a FaultAction) String() string {
+	switch a {
+	case DelayResponse:
+		return "DelayResponse"
+	case DropResponse:
+		return "DropResponse"
+	case BusyResponse:
+		return "BusyResponse"
+	case FailureResponse:
+		return "FailureResponse"
+	case CorruptResponse:
+		return "CorruptResponse"
+	case CloseConnection:
+		return "CloseConnection"
+	}
+	return "unknown"
+}
+
+// Fault describes a misbehaviour injected into the responses of a server,
+// for testing how masters cope with faulty devices.
+type Fault struct {
+	Action FaultAction
+	// Delay is how long DelayResponse holds the response.
+	Delay time.Duration
+	// Probability is the chance, from 0 to 1, that a matching request is
+	// faulted. 1, or 0 when unset, faults every matching request.
+	Probability float64
+	// Functions limits the fault to these function codes. Empty matches
+	// every function.
+	Functions []uint8
+	// Address and Quantity limit the fault to requests that access one of
+	// these addresses, in any table. A zero Quantity matches every request,
+	// including functions without an address.
+	Address  uint16
+	Quantity int
+}
+
+// matches reports whether the fault applies to a request, before its
+// probability is drawn.
+func (f *Fault) matches(frame Framer) bool {
+	if len(f.Functions) > 0 {
+		found := false
+		for _, function := range f.Functions {
+			if function == frame.GetFunction() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Quantity == 0 {
+		return true
+	}
+	for _, r := range requestAddressRanges(frame) {
+		if int(r.Start) < int(f.Address)+f.Quantity && int(f.Address) < r.end() {
+			return true
+		}
+	}
+	return false
+}
+
+// drawn reports whether the fault applies to a matching request, drawing
+// its probability.
+func (f *Fault) drawn() bool {
+	return f.Probability == 0 || rand.Float64() < f.Probability
+}
+
+// requestAddressRanges returns the address ranges accessed by a request of
+// one of the memory map functions.
+func requestAddressRanges(frame Framer) []AddressRange {
+	data := frame.GetData()
+	if len(data) < 4 {
+		return nil
+	}
+	address := binary.BigEndian.Uint16(data[0:2])
+	quantity := int(binary.BigEndian.Uint16(data[2:4]))
+
+	switch frame.GetFunction() {
+	case 1, 2, 3, 4, 15, 16:
+		return []AddressRange{{Start: address, Quantity: quantity}}
+	case 5, 6, 22:
+		return []AddressRange{{Start: address, Quantity: 1}}
+	case 23:
+		if len(data) < 8 {
+			return nil
+		}
+		return []AddressRange{
+			{Start: address, Quantity: quantity},
+			{Start: binary.BigEndian.Uint16(data[4:6]), Quantity: int(binary.BigEndian.Uint16(data[6:8]))},
+		}
+	}
+	return nil
+}
+
+// SetFaults replaces the faults injected into the responses of the server.
+// Calling it without faults stops injecting them. It is safe to call while
+// masters are connected. Faults set on a server also apply to its units; the
+// first fault that matches a request and is drawn is used.
+func (s *Server) SetFaults(faults ...Fault) {
+	s.faultsMu.Lock()
+	defer s.faultsMu.Unlock()
+	s.faults = append([]Fault{}, faults...)
+}
+
+// Faults returns the faults injected into the responses of the server.
+func (s *Server) Faults() []Fault {
+	s.faultsMu.RLock()
+	defer s.faultsMu.RUnlock()
+	return append([]Fault{}, s.faults...)
+}
+
+// pickFault returns the fault to inject into the response of the server to a
+// request, or nil. The faults of a unit come before those of the server it is
+// a unit of.
+func (s *Server) pickFault(frame Framer) *Fault {
+	for server := s; server != nil; server = server.parent {
+		server.faultsMu.RLock()
+		faults := server.faults
+		server.faultsMu.RUnlock()
+
+		for i := range faults {
+			if faults[i].matches(frame) && faults[i].drawn() {
+				return &faults[i]
+			}
+		}
+	}
+	return nil
+}
+
+// exception returns the exception answered instead of executing a request
+// faulted with BusyResponse or FailureResponse, or nil.
+func (f *Fault) exception() *Exception {
+	if f == nil {
+		return nil
+	}
+	switch f.Action {
+	case BusyResponse:
+		return &SlaveDeviceBusy
+	case FailureResponse:
+		return &SlaveDeviceFailure
+	}
+	return nil
+}
+
+// respond handles a request and writes the response, with the fault picked
+// for the request applied. Faults are picked when the request is executed,
+// so requests the server does not answer, such as broadcasts, requests for
+// other slaves or requests in listen only mode, are never faulted.
+func (s *Server) respond(request *Request) {
+	s.captureADU(request, request.frame.Bytes(), true, request.received)
+	defer s.countResponse(request)
+	response := s.handle(request)
+	fault := request.fault
+
+	responded := false
+	defer func() { s.trace(request, response, responded) }()
+	if response == nil {
+		return
+	}
+
+	bytes := response.Bytes()
+	if fault != nil {
+		switch fault.Action {
+		case DelayResponse:
+			time.Sleep(fault.Delay)
+		case DropResponse:
+			return
+		case CorruptResponse:
+			corruptResponse(response, bytes)
+		case CloseConnection:
+			if conn, ok := request.conn.(net.Conn); ok {
+				conn.Close()
+			}
+			return
+		}
+	}
+	s.captureADU(request, bytes, false, time.Now())
+	request.conn.Write(bytes)
+	responded = true
+}
+
+// corruptResponse breaks the check field of an encoded response: the CRC of
+// an RTU frame, the LRC of an ASCII frame or the MBAP length of a TCP frame.
+func corruptResponse(response Framer, bytes []byte) {
+	switch response.(type) {
+	case *RTUFrame:
+		bytes[len(bytes)-1] ^= 0xFF
+	case *ASCIIFrame:
+		// The LRC is the two hex digits before CR LF.
+		lrc := len(bytes) - 3
+		if bytes[lrc] == '0' {
+			bytes[lrc] = '1'
+		} else {
+			bytes[lrc] = '0'
+		}
+	case *TCPFrame:
+		binary.BigEndian.PutUint16(bytes[4:6], binary.BigEndian.Uint16(bytes[4:6])+1)
+	}
+}
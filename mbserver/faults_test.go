@@ -0,0 +1,148 @@
+package mbserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// faultExchange passes a request to respond and returns what the master
+// receives, nil if nothing arrives.
+func faultExchange(t *testing.T, s *Server, frame Framer) []byte {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		s.respond(&Request{conn: server, frame: frame})
+		server.Close()
+	}()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if len(got) == 0 {
+		return nil
+	}
+	return got
+}
+
+func TestFaults(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(10, []uint16{7})
+
+	frame := &TCPFrame{TransactionIdentifier: 1, Length: 6, Device: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 10, 1)
+	good := []byte{0, 1, 0, 0, 0, 5, 1, 3, 2, 0, 7}
+
+	tests := []struct {
+		fault  Fault
+		expect []byte
+	}{
+		{Fault{Action: DropResponse, Probability: 1}, nil},
+		// An unset probability faults every request.
+		{Fault{Action: DropResponse}, nil},
+		{Fault{Action: DropResponse, Probability: 0.5, Functions: []uint8{4}}, good},
+		{Fault{Action: BusyResponse, Probability: 1}, []byte{0, 1, 0, 0, 0, 3, 1, 0x83, 6}},
+		{Fault{Action: FailureResponse, Probability: 1}, []byte{0, 1, 0, 0, 0, 3, 1, 0x83, 4}},
+		{Fault{Action: CorruptResponse, Probability: 1}, []byte{0, 1, 0, 0, 0, 6, 1, 3, 2, 0, 7}},
+		{Fault{Action: CloseConnection, Probability: 1}, nil},
+		// Only other functions and addresses.
+		{Fault{Action: DropResponse, Probability: 1, Functions: []uint8{4, 6}}, good},
+		{Fault{Action: DropResponse, Probability: 1, Address: 11, Quantity: 5}, good},
+		{Fault{Action: DropResponse, Probability: 1, Functions: []uint8{3}, Address: 5, Quantity: 6}, nil},
+	}
+	for _, test := range tests {
+		s.SetFaults(test.fault)
+		got := faultExchange(t, s, frame)
+		if !bytes.Equal(test.expect, got) {
+			t.Errorf("%+v: expected %v, got %v", test.fault, test.expect, got)
+		}
+	}
+
+	s.SetFaults(Fault{Action: DelayResponse, Delay: 50 * time.Millisecond, Probability: 1})
+	start := time.Now()
+	got := faultExchange(t, s, frame)
+	if !bytes.Equal(good, got) {
+		t.Errorf("expected %v, got %v", good, got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected a delay of 50ms, got %v", elapsed)
+	}
+
+	s.SetFaults()
+	if got := faultExchange(t, s, frame); !bytes.Equal(good, got) {
+		t.Errorf("expected %v, got %v", good, got)
+	}
+}
+
+func TestFaultsUnitAndCorruptRTU(t *testing.T) {
+	s := NewServer()
+	unit := s.AddUnit(2)
+	unit.SetFaults(Fault{Action: CorruptResponse, Probability: 1})
+
+	frame := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 0, 1)
+	got := faultExchange(t, s, frame)
+	if _, err := NewRTUFrame(got); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+
+	frame.Address = 2
+	got = faultExchange(t, s, frame)
+	if _, err := NewRTUFrame(got); err == nil {
+		t.Errorf("expected CRC error, got nil")
+	}
+
+	// Faults on the server apply to its units.
+	unit.SetFaults()
+	s.SetFaults(Fault{Action: BusyResponse, Probability: 1})
+	got = faultExchange(t, s, frame)
+	response, err := NewRTUFrame(got)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if exception := GetException(response); exception != SlaveDeviceBusy {
+		t.Errorf("expected SlaveDeviceBusy, got %v", exception)
+	}
+}
+
+func TestFaultsOnlyAnsweredRequests(t *testing.T) {
+	s := NewServer()
+	s.SlaveAddress = 5
+	s.SetFaults(Fault{Action: BusyResponse, Probability: 1})
+
+	// Broadcasts and frames for other slaves stay unanswered.
+	frame := &RTUFrame{Address: 0, Function: 6}
+	SetDataWithRegisterAndNumber(frame, 0, 1)
+	if got := faultExchange(t, s, frame); got != nil {
+		t.Errorf("expected no response to a broadcast, got %v", got)
+	}
+	frame = &RTUFrame{Address: 9, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 0, 1)
+	if got := faultExchange(t, s, frame); got != nil {
+		t.Errorf("expected no response for another slave, got %v", got)
+	}
+
+	frame.Address = 5
+	response, err := NewRTUFrame(faultExchange(t, s, frame))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if exception := GetException(response); exception != SlaveDeviceBusy {
+		t.Errorf("expected SlaveDeviceBusy, got %v", exception)
+	}
+	if got := s.Diagnostics().SlaveBusyCount; got != 1 {
+		t.Errorf("expected %v, got %v", 1, got)
+	}
+
+	// Nor are requests in listen only mode.
+	s.diag.listenOnly = true
+	if got := faultExchange(t, s, frame); got != nil {
+		t.Errorf("expected no response in listen only mode, got %v", got)
+	}
+}
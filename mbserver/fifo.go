@@ -0,0 +1,60 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// maxFIFOCount is the largest number of values Read FIFO Queue can return.
+const maxFIFOCount = 31
+
+// SetFIFOQueue sets the values of the FIFO queue at a pointer address read
+// by Read FIFO Queue (function 24). Reading the queue does not remove values
+// from it. A queue holding more than 31 values is answered with
+// IllegalDataValue, as the specification requires.
+func (s *Server) SetFIFOQueue(address uint16, values []uint16) {
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	if s.fifos == nil {
+		s.fifos = make(map[uint16][]uint16)
+	}
+	s.fifos[address] = append([]uint16{}, values...)
+}
+
+// FIFOQueue returns the values of the FIFO queue at a pointer address.
+func (s *Server) FIFOQueue(address uint16) ([]uint16, error) {
+	s.filesMu.RLock()
+	defer s.filesMu.RUnlock()
+	values, ok := s.fifos[address]
+	if !ok {
+		return nil, fmt.Errorf("no FIFO queue at address %d", address)
+	}
+	return append([]uint16{}, values...), nil
+}
+
+// RemoveFIFOQueue removes the FIFO queue at a pointer address.
+func (s *Server) RemoveFIFOQueue(address uint16) {
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	delete(s.fifos, address)
+}
+
+// ReadFIFOQueue function 24, reads the count and values of a FIFO queue.
+func ReadFIFOQueue(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) != 2 {
+		return []byte{}, &IllegalDataValue
+	}
+	values, err := s.FIFOQueue(binary.BigEndian.Uint16(data[0:2]))
+	if err != nil {
+		return []byte{}, &IllegalDataAddress
+	}
+	if len(values) > maxFIFOCount {
+		return []byte{}, &IllegalDataValue
+	}
+
+	response := make([]byte, 4)
+	binary.BigEndian.PutUint16(response[0:2], uint16(2+len(values)*2))
+	binary.BigEndian.PutUint16(response[2:4], uint16(len(values)))
+	return append(response, Uint16ToBytes(values)...), &Success
+}
@@ -0,0 +1,52 @@
+package mbserver
+
+import "testing"
+
+// Function 24
+func TestReadFIFOQueue(t *testing.T) {
+	s := NewServer()
+	s.SetFIFOQueue(0x04DE, []uint16{0x01B8, 0x1284})
+
+	response := handleRequest(s, 24, []byte{0x04, 0xDE})
+	exception := GetException(response)
+	if exception != Success {
+		t.Fatalf("expected Success, got %v", exception.String())
+	}
+	// Example from the Modbus Application Protocol specification.
+	expect := []byte{0, 6, 0, 2, 0x01, 0xB8, 0x12, 0x84}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// Reading does not empty the queue.
+	values, err := s.FIFOQueue(0x04DE)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expectValues := []uint16{0x01B8, 0x1284}
+	if !isEqual(expectValues, values) {
+		t.Errorf("expected %v, got %v", expectValues, values)
+	}
+}
+
+func TestReadFIFOQueueInvalid(t *testing.T) {
+	s := NewServer()
+	s.SetFIFOQueue(1, make([]uint16, 32))
+
+	tests := []struct {
+		data   []byte
+		expect Exception
+	}{
+		{[]byte{0}, IllegalDataValue},
+		{[]byte{0, 2}, IllegalDataAddress},
+		{[]byte{0, 1}, IllegalDataValue},
+	}
+	for _, test := range tests {
+		response := handleRequest(s, 24, test.data)
+		exception := GetException(response)
+		if exception != test.expect {
+			t.Errorf("%v: expected %v, got %v", test.data, test.expect.String(), exception.String())
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// fileRecordReferenceType is the only reference type of a file record
+// sub-request.
+const fileRecordReferenceType = 6
+
+// maxFileRecords is the number of records a file can hold, record numbers
+// range from 0 to 9999.
+const maxFileRecords = 10000
+
+// SetFileRecords sets 16-bit records of a file, starting at a record number,
+// for Read File Record (function 20) and Write File Record (function 21).
+// The file is created or extended as needed. Masters can only access records
+// that exist.
+func (s *Server) SetFileRecords(file uint16, record uint16, values []uint16) error {
+	if file == 0 {
+		return fmt.Errorf("file number 0 is not allowed")
+	}
+	end := int(record) + len(values)
+	if end > maxFileRecords {
+		return fmt.Errorf("file record %d is beyond the last record number %d", end-1, maxFileRecords-1)
+	}
+
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	if s.files == nil {
+		s.files = make(map[uint16][]uint16)
+	}
+	records := s.files[file]
+	if len(records) < end {
+		records = append(records, make([]uint16, end-len(records))...)
+	}
+	copy(records[record:], values)
+	s.files[file] = records
+	return nil
+}
+
+// FileRecords returns n records of a file, starting at a record number.
+func (s *Server) FileRecords(file uint16, record uint16, n int) ([]uint16, error) {
+	s.filesMu.RLock()
+	defer s.filesMu.RUnlock()
+	records, ok := s.files[file]
+	if !ok {
+		return nil, fmt.Errorf("file %d does not exist", file)
+	}
+	if n < 0 || int(record)+n > len(records) {
+		return nil, fmt.Errorf("file %d has %d records", file, len(records))
+	}
+	return append([]uint16{}, records[record:int(record)+n]...), nil
+}
+
+// fileRecordRequest is a sub-request of a Read or Write File Record request.
+type fileRecordRequest struct {
+	file   uint16
+	record uint16
+	length int
+	values []byte
+}
+
+// parseFileRecordRequests splits the data of a Read File Record request, or
+// with withValues set a Write File Record request, into sub-requests.
+func parseFileRecordRequests(data []byte, withValues bool) ([]fileRecordRequest, *Exception) {
+	if len(data) < 1 || int(data[0]) != len(data)-1 {
+		return nil, &IllegalDataValue
+	}
+	data = data[1:]
+
+	var requests []fileRecordRequest
+	for len(data) > 0 {
+		if len(data) < 7 {
+			return nil, &IllegalDataValue
+		}
+		request := fileRecordRequest{
+			file:   binary.BigEndian.Uint16(data[1:3]),
+			record: binary.BigEndian.Uint16(data[3:5]),
+			length: int(binary.BigEndian.Uint16(data[5:7])),
+		}
+		if data[0] != fileRecordReferenceType || request.file == 0 || request.record >= maxFileRecords {
+			return nil, &IllegalDataAddress
+		}
+		data = data[7:]
+
+		if withValues {
+			if len(data) < request.length*2 {
+				return nil, &IllegalDataValue
+			}
+			request.values = data[:request.length*2]
+			data = data[request.length*2:]
+		}
+		requests = append(requests, request)
+	}
+	return requests, &Success
+}
+
+// ReadFileRecord function 20, reads groups of records from files.
+func ReadFileRecord(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) < 8 || len(data) > 246 || (len(data)-1)%7 != 0 {
+		return []byte{}, &IllegalDataValue
+	}
+	requests, exception := parseFileRecordRequests(data, false)
+	if exception != &Success {
+		return []byte{}, exception
+	}
+
+	response := []byte{0}
+	for _, request := range requests {
+		values, err := s.FileRecords(request.file, request.record, request.length)
+		if err != nil {
+			return []byte{}, &IllegalDataAddress
+		}
+		response = append(response, byte(1+len(values)*2), fileRecordReferenceType)
+		response = append(response, Uint16ToBytes(values)...)
+	}
+	// The response data length is at most 0xF5.
+	if len(response)-1 > 0xF5 {
+		return []byte{}, &IllegalDataValue
+	}
+	response[0] = byte(len(response) - 1)
+	return response, &Success
+}
+
+// WriteFileRecord function 21, writes groups of records to files.
+// Only records that already exist can be written.
+func WriteFileRecord(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) < 10 || len(data) > 252 {
+		return []byte{}, &IllegalDataValue
+	}
+	requests, exception := parseFileRecordRequests(data, true)
+	if exception != &Success {
+		return []byte{}, exception
+	}
+
+	// Check every sub-request before writing any of them.
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	for _, request := range requests {
+		if int(request.record)+request.length > len(s.files[request.file]) {
+			return []byte{}, &IllegalDataAddress
+		}
+	}
+	for _, request := range requests {
+		copy(s.files[request.file][request.record:], BytesToUint16(request.values))
+	}
+	return data, &Success
+}
@@ -0,0 +1,102 @@
+package mbserver
+
+import "testing"
+
+// Function 20
+func TestReadFileRecord(t *testing.T) {
+	s := NewServer()
+	s.SetFileRecords(4, 1, []uint16{0x0DFE, 0x0020})
+	s.SetFileRecords(3, 9, []uint16{0x33CD, 0x0040})
+
+	// Example from the Modbus Application Protocol specification.
+	response := handleRequest(s, 20, []byte{0x0E,
+		6, 0, 4, 0, 1, 0, 2,
+		6, 0, 3, 0, 9, 0, 2})
+	exception := GetException(response)
+	if exception != Success {
+		t.Fatalf("expected Success, got %v", exception.String())
+	}
+	expect := []byte{0x0C,
+		5, 6, 0x0D, 0xFE, 0x00, 0x20,
+		5, 6, 0x33, 0xCD, 0x00, 0x40}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestReadFileRecordInvalid(t *testing.T) {
+	s := NewServer()
+	s.SetFileRecords(4, 0, []uint16{1, 2})
+
+	tests := []struct {
+		data   []byte
+		expect Exception
+	}{
+		// Byte count does not match.
+		{[]byte{0x08, 6, 0, 4, 0, 0, 0, 1}, IllegalDataValue},
+		// Incomplete sub-request.
+		{[]byte{0x06, 6, 0, 4, 0, 0, 0}, IllegalDataValue},
+		// Bad reference type.
+		{[]byte{0x07, 5, 0, 4, 0, 0, 0, 1}, IllegalDataAddress},
+		// File number 0.
+		{[]byte{0x07, 6, 0, 0, 0, 0, 0, 1}, IllegalDataAddress},
+		// Record number above 9999.
+		{[]byte{0x07, 6, 0, 4, 0x27, 0x10, 0, 1}, IllegalDataAddress},
+		// Beyond the end of the file.
+		{[]byte{0x07, 6, 0, 4, 0, 1, 0, 2}, IllegalDataAddress},
+		// Unknown file.
+		{[]byte{0x07, 6, 0, 5, 0, 0, 0, 1}, IllegalDataAddress},
+	}
+	for _, test := range tests {
+		response := handleRequest(s, 20, test.data)
+		exception := GetException(response)
+		if exception != test.expect {
+			t.Errorf("%v: expected %v, got %v", test.data, test.expect.String(), exception.String())
+		}
+	}
+}
+
+// Function 21
+func TestWriteFileRecord(t *testing.T) {
+	s := NewServer()
+	s.SetFileRecords(4, 0, make([]uint16, 10))
+
+	// Example from the Modbus Application Protocol specification.
+	data := []byte{0x0D, 6, 0, 4, 0, 7, 0, 3, 0x06, 0xAF, 0x04, 0xBE, 0x10, 0x0D}
+	response := handleRequest(s, 21, data)
+	exception := GetException(response)
+	if exception != Success {
+		t.Fatalf("expected Success, got %v", exception.String())
+	}
+	got := response.GetData()
+	if !isEqual(data, got) {
+		t.Errorf("expected %v, got %v", data, got)
+	}
+
+	records, err := s.FileRecords(4, 7, 3)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []uint16{0x06AF, 0x04BE, 0x100D}
+	if !isEqual(expect, records) {
+		t.Errorf("expected %v, got %v", expect, records)
+	}
+
+	// Records beyond the end of the file are not created by masters.
+	response = handleRequest(s, 21, []byte{0x09, 6, 0, 4, 0, 10, 0, 1, 0, 1})
+	exception = GetException(response)
+	if exception != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", exception.String())
+	}
+}
+
+func TestSetFileRecordsInvalid(t *testing.T) {
+	s := NewServer()
+	if err := s.SetFileRecords(0, 0, []uint16{1}); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+	if err := s.SetFileRecords(1, 9999, []uint16{1, 2}); err == nil {
+		t.Errorf("expected error not nil, got %v", err)
+	}
+}
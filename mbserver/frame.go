@@ -8,6 +8,7 @@ type Framer interface {
 	Copy() Framer
 	GetData() []byte
 	GetFunction() uint8
+	GetUnitID() uint8
 	SetException(exception *Exception)
 	SetData(data []byte)
 }
@@ -15,22 +16,32 @@ type Framer interface {
 // GetException retunrns the Modbus exception or Success (indicating not exception).
 func GetException(frame Framer) (exception Exception) {
 	function := frame.GetFunction()
-	if (function & 0x80) != 0 {
+	if (function&0x80) != 0 && len(frame.GetData()) > 0 {
 		exception = Exception(frame.GetData()[0])
 	}
 	return exception
 }
 
+// registerAddressAndNumber returns the address and quantity at the start of
+// the request data, or zeros if the data is too short.
 func registerAddressAndNumber(frame Framer) (register int, numRegs int, endRegister int) {
 	data := frame.GetData()
+	if len(data) < 4 {
+		return 0, 0, 0
+	}
 	register = int(binary.BigEndian.Uint16(data[0:2]))
 	numRegs = int(binary.BigEndian.Uint16(data[2:4]))
 	endRegister = register + numRegs
 	return register, numRegs, endRegister
 }
 
+// registerAddressAndValue returns the address and value at the start of the
+// request data, or zeros if the data is too short.
 func registerAddressAndValue(frame Framer) (int, uint16) {
 	data := frame.GetData()
+	if len(data) < 4 {
+		return 0, 0
+	}
 	register := int(binary.BigEndian.Uint16(data[0:2]))
 	value := binary.BigEndian.Uint16(data[2:4])
 	return register, value
@@ -0,0 +1,115 @@
+package mbserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// asciiMaxADULength is the largest Modbus ASCII ADU in characters: ':',
+// address, function, 252 data bytes and LRC as hex digits, then CR LF.
+const asciiMaxADULength = 513
+
+// ASCIIFrame is the Modbus ASCII frame.
+type ASCIIFrame struct {
+	Address  uint8
+	Function uint8
+	Data     []byte
+	LRC      uint8
+}
+
+// NewASCIIFrame converts a packet, from the ':' start character up to and
+// including the CR LF end characters, to a Modbus ASCII frame.
+func NewASCIIFrame(packet []byte) (*ASCIIFrame, error) {
+	return newASCIIFrame(packet, '\n')
+}
+
+// newASCIIFrame converts a packet ending with CR and the given delimiter to a
+// Modbus ASCII frame.
+func newASCIIFrame(packet []byte, delimiter byte) (*ASCIIFrame, error) {
+	pLen := len(packet)
+	if pLen < 9 {
+		return nil, fmt.Errorf("ASCII Frame error: packet less than 9 bytes: %q", packet)
+	}
+	if packet[0] != ':' || packet[pLen-2] != '\r' || packet[pLen-1] != delimiter {
+		return nil, fmt.Errorf("ASCII Frame error: missing start or end characters: %q", packet)
+	}
+
+	bytes, err := hex.DecodeString(string(packet[1 : pLen-2]))
+	if err != nil {
+		return nil, fmt.Errorf("ASCII Frame error: %v", err)
+	}
+
+	// Check the LRC.
+	bLen := len(bytes)
+	lrcExpect := bytes[bLen-1]
+	lrcCalc := lrcModbus(bytes[0 : bLen-1])
+	if lrcCalc != lrcExpect {
+		return nil, fmt.Errorf("ASCII Frame error: LRC (expected 0x%x, got 0x%x)", lrcExpect, lrcCalc)
+	}
+
+	frame := &ASCIIFrame{
+		Address:  bytes[0],
+		Function: bytes[1],
+		Data:     bytes[2 : bLen-1],
+		LRC:      lrcExpect,
+	}
+
+	return frame, nil
+}
+
+// lrcModbus returns the longitudinal redundancy check of data, the two's
+// complement of the sum of all bytes.
+func lrcModbus(data []byte) uint8 {
+	var sum uint8
+	for _, v := range data {
+		sum += v
+	}
+	return -sum
+}
+
+// Copy the ASCIIFrame.
+func (frame *ASCIIFrame) Copy() Framer {
+	copy := *frame
+	return &copy
+}
+
+// Bytes returns the Modbus byte stream based on the ASCIIFrame fields
+func (frame *ASCIIFrame) Bytes() []byte {
+	bytes := make([]byte, 2)
+
+	bytes[0] = frame.Address
+	bytes[1] = frame.Function
+	bytes = append(bytes, frame.Data...)
+
+	// Add the LRC.
+	bytes = append(bytes, lrcModbus(bytes))
+
+	return []byte(":" + strings.ToUpper(hex.EncodeToString(bytes)) + "\r\n")
+}
+
+// GetFunction returns the Modbus function code.
+func (frame *ASCIIFrame) GetFunction() uint8 {
+	return frame.Function
+}
+
+// GetUnitID returns the Modbus unit identifier (the slave Address field).
+func (frame *ASCIIFrame) GetUnitID() uint8 {
+	return frame.Address
+}
+
+// GetData returns the ASCIIFrame Data byte field.
+func (frame *ASCIIFrame) GetData() []byte {
+	return frame.Data
+}
+
+// SetData sets the ASCIIFrame Data byte field.
+func (frame *ASCIIFrame) SetData(data []byte) {
+	frame.Data = data
+}
+
+// SetException sets the Modbus exception code in the frame.
+func (frame *ASCIIFrame) SetException(exception *Exception) {
+	frame.Function = frame.Function | 0x80
+	frame.Data = []byte{byte(*exception)}
+}
@@ -0,0 +1,186 @@
+package mbserver
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewASCIIFrame(t *testing.T) {
+	frame, err := NewASCIIFrame([]byte(":010300000001FB\r\n"))
+	if !isEqual(nil, err) {
+		t.Fatalf("expected %v, got %v", nil, err)
+	}
+
+	got := frame.Address
+	expect := 1
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	got = frame.Function
+	expect = 3
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	expectData := []byte{0, 0, 0, 1}
+	gotData := frame.Data
+	if !isEqual(expectData, gotData) {
+		t.Errorf("expected %v, got %v", expectData, gotData)
+	}
+}
+
+func TestNewASCIIFrameNoData(t *testing.T) {
+	frame, err := NewASCIIFrame([]byte(":0107F8\r\n"))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if frame.Address != 1 || frame.Function != 7 || len(frame.Data) != 0 {
+		t.Errorf("expected unit 1 function 7 without data, got %+v", frame)
+	}
+	if got := string(frame.Bytes()); got != ":0107F8\r\n" {
+		t.Errorf("expected %q, got %q", ":0107F8\r\n", got)
+	}
+
+	if _, err := NewASCIIFrame([]byte(":01F8\r\n")); err == nil {
+		t.Errorf("expected an error for a frame without a function code")
+	}
+}
+
+func TestNewASCIIFrameBadLRC(t *testing.T) {
+	_, err := NewASCIIFrame([]byte(":010300000001FC\r\n"))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
+
+func TestNewASCIIFrameMissingEnd(t *testing.T) {
+	_, err := NewASCIIFrame([]byte(":010300000001FB"))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
+
+func TestASCIIFrameBytes(t *testing.T) {
+	frame := &ASCIIFrame{
+		Address:  uint8(1),
+		Function: uint8(3),
+		Data:     []byte{0x02, 0xff, 0xff},
+	}
+
+	got := string(frame.Bytes())
+	expect := ":010302FFFFFC\r\n"
+	if expect != got {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+}
+
+func TestModbusASCIITCP(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{7})
+	addr := getFreePort()
+	err := s.ListenASCIITCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Noise and a frame with a bad LRC, then a good frame in two writes.
+	if _, err := conn.Write([]byte("xx:010300000001FC\r\n:0103000000")); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Write([]byte("01FB\r\n")); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read, got %v\n", err)
+	}
+	expect := ":0103020007F3\r\n"
+	if expect != got {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+}
+
+func TestModbusASCIITCPNoData(t *testing.T) {
+	s := NewServer()
+	addr := getFreePort()
+	err := s.ListenASCIITCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Read Exception Status has no request data.
+	if _, err := conn.Write([]byte(":0107F8\r\n")); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read, got %v\n", err)
+	}
+	expect := ":010700F8\r\n"
+	if expect != got {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+}
+
+func TestModbusASCIIUnitDelimiter(t *testing.T) {
+	s := NewServer()
+	s.AddUnit(2)
+	addr := getFreePort()
+	err := s.ListenASCIITCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// A unit changes the input delimiter of the line to '!'.
+	change := &ASCIIFrame{Address: 2, Function: 8, Data: []byte{0, diagChangeASCIIInputDelimiter, '!', 0}}
+	if _, err := conn.Write(change.Bytes()); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("failed to read, got %v\n", err)
+	}
+
+	request := []byte(":010300000001FB\r!")
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+	got, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read, got %v\n", err)
+	}
+	expect := ":0103020000FA\r\n"
+	if expect != got {
+		t.Errorf("expected %q, got %q", expect, got)
+	}
+}
@@ -5,6 +5,10 @@ import (
 	"fmt"
 )
 
+// rtuMaxADULength is the largest Modbus RTU ADU, an address, a PDU of at most
+// 253 bytes and a CRC.
+const rtuMaxADULength = 256
+
 // RTUFrame is the Modbus TCP frame.
 type RTUFrame struct {
 	Address  uint8
@@ -16,8 +20,8 @@ type RTUFrame struct {
 // NewRTUFrame converts a packet to a Modbus TCP frame.
 func NewRTUFrame(packet []byte) (*RTUFrame, error) {
 	// Check the that the packet length.
-	if len(packet) < 5 {
-		return nil, fmt.Errorf("RTU Frame error: packet less than 5 bytes: %v", packet)
+	if len(packet) < 4 {
+		return nil, fmt.Errorf("RTU Frame error: packet less than 4 bytes: %v", packet)
 	}
 
 	// Check the CRC.
@@ -37,6 +41,116 @@ func NewRTUFrame(packet []byte) (*RTUFrame, error) {
 	return frame, nil
 }
 
+// rtuRequestLength returns the length of the RTU request ADU at the start of
+// packet, worked out from the function code and, for functions with a
+// variable length, the byte count field. It returns 0 when more bytes are
+// needed to tell and -1 for function codes of unknown length.
+func rtuRequestLength(packet []byte) int {
+	if len(packet) < 2 {
+		return 0
+	}
+	switch packet[1] {
+	case 1, 2, 3, 4, 5, 6:
+		return 8
+	case 8:
+		// Return Query Data echoes data of any length.
+		if len(packet) < 4 {
+			return 0
+		}
+		if binary.BigEndian.Uint16(packet[2:4]) == diagReturnQueryData {
+			return -1
+		}
+		return 8
+	case 7, 11, 12:
+		return 4
+	case 15, 16:
+		if len(packet) < 7 {
+			return 0
+		}
+		return 9 + int(packet[6])
+	case 20, 21:
+		if len(packet) < 3 {
+			return 0
+		}
+		return 5 + int(packet[2])
+	case 22:
+		return 10
+	case 23:
+		if len(packet) < 11 {
+			return 0
+		}
+		return 13 + int(packet[10])
+	case 24:
+		return 6
+	case 43:
+		if len(packet) < 3 {
+			return 0
+		}
+		if packet[2] == meiReadDeviceIdentification {
+			return 7
+		}
+	}
+	return -1
+}
+
+// matchRTUFrame returns the shortest RTU frame at the start of buffer with a
+// valid CRC and its length, for function codes of unknown length. It returns
+// nil if no prefix of buffer is a frame.
+func matchRTUFrame(buffer []byte) (*RTUFrame, int) {
+	for length := 4; length <= len(buffer) && length <= rtuMaxADULength; length++ {
+		if frame, err := NewRTUFrame(buffer[:length]); err == nil {
+			return frame, length
+		}
+	}
+	return nil, 0
+}
+
+// resyncRTUFrame returns the offset in buffer of the first complete request
+// of known length with a valid CRC after the start of buffer, or 0 if there
+// is none. The bytes before it are the remains of a broken frame.
+func resyncRTUFrame(buffer []byte) int {
+	for i := 1; i < len(buffer); i++ {
+		length := rtuRequestLength(buffer[i:])
+		if length <= 0 || len(buffer)-i < length {
+			continue
+		}
+		if _, err := NewRTUFrame(buffer[i : i+length]); err == nil {
+			return i
+		}
+	}
+	return 0
+}
+
+// nextRTUFrame splits the first RTU request off a buffer of received bytes
+// and returns it with the number of bytes consumed. A consumed count of 0
+// means more bytes are needed. endOfFrame reports that the line has been
+// silent since the last byte in buffer, which ends frames of unknown length
+// and discards incomplete ones. On a bad CRC the bytes up to the silence are
+// dropped, or, while more bytes may follow, just the first byte so that the
+// next call can resync on the following frame.
+func nextRTUFrame(buffer []byte, endOfFrame bool) (*RTUFrame, int, error) {
+	length := rtuRequestLength(buffer)
+	switch {
+	case length > 0 && len(buffer) >= length:
+		frame, err := NewRTUFrame(buffer[:length])
+		if err != nil {
+			if endOfFrame {
+				return nil, len(buffer), err
+			}
+			return nil, 1, err
+		}
+		return frame, length, nil
+	case !endOfFrame:
+		return nil, 0, nil
+	case length < 0:
+		// Everything received before the silence is the frame.
+		frame, err := NewRTUFrame(buffer)
+		return frame, len(buffer), err
+	default:
+		return nil, len(buffer), fmt.Errorf("RTU Frame error: incomplete frame: %v", buffer)
+	}
+}
+
 // Copy the RTUFrame.
 func (frame *RTUFrame) Copy() Framer {
 	copy := *frame
@@ -67,6 +181,11 @@ func (frame *RTUFrame) GetFunction() uint8 {
 	return frame.Function
 }
 
+// GetUnitID returns the Modbus unit identifier (the slave Address field).
+func (frame *RTUFrame) GetUnitID() uint8 {
+	return frame.Address
+}
+
 // GetData returns the RTUFrame Data byte field.
 func (frame *RTUFrame) GetData() []byte {
 	return frame.Data
@@ -49,3 +49,114 @@ func TestRTUFrameBytes(t *testing.T) {
 		t.Errorf("expected %v, got %v", expect, got)
 	}
 }
+
+func TestRTURequestLength(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		expect int
+	}{
+		{[]byte{0x01}, 0},
+		{[]byte{0x01, 0x03}, 8},
+		{[]byte{0x01, 0x10, 0x00, 0x01, 0x00, 0x02}, 0},
+		{[]byte{0x01, 0x10, 0x00, 0x01, 0x00, 0x02, 0x04}, 13},
+		{[]byte{0x01, 0x16}, 10},
+		{[]byte{0x01, 0x17, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01}, 0},
+		{[]byte{0x01, 0x17, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x02}, 15},
+		{[]byte{0x01, 0x08, 0x00}, 0},
+		{[]byte{0x01, 0x08, 0x00, 0x0B}, 8},
+		{[]byte{0x01, 0x08, 0x00, 0x00}, -1},
+		{[]byte{0x01, 0x64}, -1},
+	}
+	for _, test := range tests {
+		got := rtuRequestLength(test.packet)
+		if got != test.expect {
+			t.Errorf("%v: expected %v, got %v", test.packet, test.expect, got)
+		}
+	}
+}
+
+func TestNextRTUFrame(t *testing.T) {
+	request := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(request, 0, 2)
+	packet := request.Bytes()
+
+	// A partial frame needs more bytes.
+	_, consumed, err := nextRTUFrame(packet[:5], false)
+	if consumed != 0 || err != nil {
+		t.Errorf("expected 0 and nil, got %v and %v", consumed, err)
+	}
+
+	// A partial frame followed by silence is dropped.
+	_, consumed, err = nextRTUFrame(packet[:5], true)
+	if consumed != 5 || err == nil {
+		t.Errorf("expected 5 and an error, got %v and %v", consumed, err)
+	}
+
+	// Two frames back to back.
+	buffer := append(append([]byte{}, packet...), packet...)
+	frame, consumed, err := nextRTUFrame(buffer, false)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if consumed != len(packet) {
+		t.Errorf("expected %v, got %v", len(packet), consumed)
+	}
+	expect := []byte{0, 0, 0, 2}
+	got := frame.Data
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestNextRTUFrameResync(t *testing.T) {
+	request := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(request, 0, 2)
+
+	// A stray byte in front of the frame is skipped one byte at a time.
+	buffer := append([]byte{0x01}, request.Bytes()...)
+	_, consumed, err := nextRTUFrame(buffer, false)
+	if consumed != 1 || err == nil {
+		t.Fatalf("expected 1 and an error, got %v and %v", consumed, err)
+	}
+	frame, _, err := nextRTUFrame(buffer[consumed:], false)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if frame.Function != 3 {
+		t.Errorf("expected %v, got %v", 3, frame.Function)
+	}
+}
+
+func TestMatchRTUFrame(t *testing.T) {
+	custom := &RTUFrame{Address: 1, Function: 65, Data: []byte{1, 2, 3}}
+	request := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(request, 0, 2)
+
+	buffer := append(custom.Bytes(), request.Bytes()...)
+	frame, length := matchRTUFrame(buffer)
+	if frame == nil || length != len(custom.Bytes()) {
+		t.Fatalf("expected a frame of %v bytes, got %v %v", len(custom.Bytes()), frame, length)
+	}
+	if !isEqual(custom.Data, frame.Data) {
+		t.Errorf("expected %v, got %v", custom.Data, frame.Data)
+	}
+
+	if frame, _ := matchRTUFrame(custom.Bytes()[:5]); frame != nil {
+		t.Errorf("expected nil, got %v", frame)
+	}
+}
+
+func TestResyncRTUFrame(t *testing.T) {
+	request := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(request, 0, 2)
+	packet := request.Bytes()
+
+	// The remains of a broken frame before a complete request.
+	buffer := append([]byte{0x00, 0x00, 0x01}, packet...)
+	if got := resyncRTUFrame(buffer); got != 3 {
+		t.Errorf("expected %v, got %v", 3, got)
+	}
+	if got := resyncRTUFrame(buffer[:len(buffer)-1]); got != 0 {
+		t.Errorf("expected %v, got %v", 0, got)
+	}
+}
@@ -3,8 +3,13 @@ package mbserver
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
+// tcpMaxADULength is the largest Modbus TCP ADU, a 7 byte MBAP header
+// followed by a PDU of at most 253 bytes.
+const tcpMaxADULength = 260
+
 // TCPFrame is the Modbus TCP frame.
 type TCPFrame struct {
 	TransactionIdentifier uint16
@@ -17,9 +22,10 @@ type TCPFrame struct {
 
 // NewTCPFrame converts a packet to a Modbus TCP frame.
 func NewTCPFrame(packet []byte) (*TCPFrame, error) {
-	// Check if the packet is too short.
-	if len(packet) < 9 {
-		return nil, fmt.Errorf("TCP Frame error: packet less than 9 bytes")
+	// Check if the packet is too short. Requests such as Read Exception
+	// Status have no data after the function code.
+	if len(packet) < 8 {
+		return nil, fmt.Errorf("TCP Frame error: packet less than 8 bytes")
 	}
 
 	frame := &TCPFrame{
@@ -39,6 +45,28 @@ func NewTCPFrame(packet []byte) (*TCPFrame, error) {
 	return frame, nil
 }
 
+// readTCPFrame reads one Modbus TCP ADU from a byte stream. The MBAP length
+// field is used to find the end of the frame, so frames split across reads
+// and several frames in a single read are both handled. io.EOF is returned
+// when the stream ends on a frame boundary.
+func readTCPFrame(r io.Reader) (*TCPFrame, error) {
+	packet := make([]byte, tcpMaxADULength)
+	if _, err := io.ReadFull(r, packet[:7]); err != nil {
+		return nil, err
+	}
+
+	// The length counts the unit identifier and the PDU.
+	length := int(binary.BigEndian.Uint16(packet[4:6]))
+	if length < 2 || 6+length > tcpMaxADULength {
+		return nil, fmt.Errorf("TCP Frame error: invalid MBAP length %d", length)
+	}
+	if _, err := io.ReadFull(r, packet[7:6+length]); err != nil {
+		return nil, err
+	}
+
+	return NewTCPFrame(packet[:6+length])
+}
+
 // Copy the TCPFrame.
 func (frame *TCPFrame) Copy() Framer {
 	copy := *frame
@@ -64,6 +92,11 @@ func (frame *TCPFrame) GetFunction() uint8 {
 	return frame.Function
 }
 
+// GetUnitID returns the Modbus unit identifier (the Device field).
+func (frame *TCPFrame) GetUnitID() uint8 {
+	return frame.Device
+}
+
 // GetData returns the TCPFrame Data byte field.
 func (frame *TCPFrame) GetData() []byte {
 	return frame.Data
@@ -0,0 +1,66 @@
+package mbserver
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReadTCPFrameStream(t *testing.T) {
+	// Two read holding register requests back to back.
+	stream := bytes.NewReader([]byte{
+		0, 1, 0, 0, 0, 6, 1, 3, 0, 0, 0, 1,
+		0, 2, 0, 0, 0, 6, 2, 3, 0, 10, 0, 2,
+	})
+
+	frame, err := readTCPFrame(stream)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if frame.TransactionIdentifier != 1 || frame.Device != 1 {
+		t.Errorf("expected transaction 1 for unit 1, got %d for unit %d", frame.TransactionIdentifier, frame.Device)
+	}
+
+	frame, err = readTCPFrame(stream)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []byte{0, 10, 0, 2}
+	got := frame.Data
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	_, err = readTCPFrame(stream)
+	if err != io.EOF {
+		t.Errorf("expected %v, got %v", io.EOF, err)
+	}
+}
+
+func TestReadTCPFrameTruncated(t *testing.T) {
+	_, err := readTCPFrame(bytes.NewReader([]byte{0, 1, 0, 0, 0, 6, 1, 3, 0}))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestReadTCPFrameBadLength(t *testing.T) {
+	_, err := readTCPFrame(bytes.NewReader([]byte{0, 1, 0, 0, 1, 0, 1, 3, 0, 0, 0, 1}))
+	if err == nil {
+		t.Fatalf("expected error not nil, got %v", err)
+	}
+}
+
+func TestNewTCPFrameNoData(t *testing.T) {
+	frame, err := NewTCPFrame([]byte{0, 1, 0, 0, 0, 2, 1, 11})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if frame.Function != 11 || len(frame.Data) != 0 {
+		t.Errorf("expected function 11 without data, got %+v", frame)
+	}
+
+	if _, err := NewTCPFrame([]byte{0, 1, 0, 0, 0, 1, 1}); err == nil {
+		t.Errorf("expected an error for a frame without a function code")
+	}
+}
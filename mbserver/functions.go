@@ -4,137 +4,257 @@ import (
 	"encoding/binary"
 )
 
+// Quantity limits of the read and write functions.
+const (
+	maxReadBits       = 2000
+	maxReadRegisters  = 125
+	maxWriteBits      = 1968
+	maxWriteRegisters = 123
+)
+
+// Values of a coil in a Write Single Coil request.
+const (
+	coilOff = 0x0000
+	coilOn  = 0xFF00
+)
+
+// readRequest returns the address and quantity of a read request, or
+// IllegalDataValue if the request is not 4 bytes long or the quantity is not
+// between 1 and max.
+func readRequest(frame Framer, max int) (uint16, int, *Exception) {
+	if len(frame.GetData()) != 4 {
+		return 0, 0, &IllegalDataValue
+	}
+	register, numRegs, _ := registerAddressAndNumber(frame)
+	if numRegs < 1 || numRegs > max {
+		return 0, 0, &IllegalDataValue
+	}
+	return uint16(register), numRegs, &Success
+}
+
+// writeMultipleRequest returns the address, quantity and value bytes of a
+// Write Multiple Coils (with bits set) or Write Multiple Registers request,
+// or IllegalDataValue if the quantity is not between 1 and max or does not
+// match the byte count and the length of the request.
+func writeMultipleRequest(frame Framer, max int, bits bool) (uint16, int, []byte, *Exception) {
+	data := frame.GetData()
+	if len(data) < 5 {
+		return 0, 0, nil, &IllegalDataValue
+	}
+	register, numRegs, _ := registerAddressAndNumber(frame)
+	byteCount := numRegs * 2
+	if bits {
+		byteCount = (numRegs + 7) / 8
+	}
+	if numRegs < 1 || numRegs > max || int(data[4]) != byteCount || len(data) != 5+byteCount {
+		return 0, 0, nil, &IllegalDataValue
+	}
+	return uint16(register), numRegs, data[5:], &Success
+}
+
 // ReadCoils function 1, reads coils from internal memory.
 func ReadCoils(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	if endRegister > 65535 {
-		return []byte{}, &IllegalDataAddress
+	register, numRegs, exception := readRequest(frame, maxReadBits)
+	if exception != &Success {
+		return []byte{}, exception
 	}
-	dataSize := numRegs / 8
-	if (numRegs % 8) != 0 {
-		dataSize++
+	if !s.mapped(Coils, register, numRegs, false) {
+		return []byte{}, &IllegalDataAddress
 	}
-	data := make([]byte, 1+dataSize)
-	data[0] = byte(dataSize)
-	for i, value := range s.Coils[register:endRegister] {
-		if value != 0 {
-			shift := uint(i) % 8
-			data[1+i/8] |= byte(1 << shift)
-		}
+	values, err := s.ReadCoils(register, numRegs)
+	if err != nil {
+		return []byte{}, &IllegalDataAddress
 	}
-	return data, &Success
+	return bitsToBytes(values), &Success
 }
 
 // ReadDiscreteInputs function 2, reads discrete inputs from internal memory.
 func ReadDiscreteInputs(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	if endRegister > 65535 {
-		return []byte{}, &IllegalDataAddress
+	register, numRegs, exception := readRequest(frame, maxReadBits)
+	if exception != &Success {
+		return []byte{}, exception
 	}
-	dataSize := numRegs / 8
-	if (numRegs % 8) != 0 {
-		dataSize++
+	if !s.mapped(DiscreteInputs, register, numRegs, false) {
+		return []byte{}, &IllegalDataAddress
 	}
-	data := make([]byte, 1+dataSize)
-	data[0] = byte(dataSize)
-	for i, value := range s.DiscreteInputs[register:endRegister] {
-		if value != 0 {
-			shift := uint(i) % 8
-			data[1+i/8] |= byte(1 << shift)
-		}
+	values, err := s.ReadDiscrete(register, numRegs)
+	if err != nil {
+		return []byte{}, &IllegalDataAddress
 	}
-	return data, &Success
+	return bitsToBytes(values), &Success
 }
 
 // ReadHoldingRegisters function 3, reads holding registers from internal memory.
 func ReadHoldingRegisters(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	if endRegister > 65536 {
+	register, numRegs, exception := readRequest(frame, maxReadRegisters)
+	if exception != &Success {
+		return []byte{}, exception
+	}
+	if !s.mapped(HoldingRegisters, register, numRegs, false) {
 		return []byte{}, &IllegalDataAddress
 	}
-	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(s.HoldingRegisters[register:endRegister])...), &Success
+	values, err := s.ReadHolding(register, numRegs)
+	if err != nil {
+		return []byte{}, &IllegalDataAddress
+	}
+	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(values)...), &Success
 }
 
 // ReadInputRegisters function 4, reads input registers from internal memory.
 func ReadInputRegisters(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	if endRegister > 65536 {
+	register, numRegs, exception := readRequest(frame, maxReadRegisters)
+	if exception != &Success {
+		return []byte{}, exception
+	}
+	if !s.mapped(InputRegisters, register, numRegs, false) {
+		return []byte{}, &IllegalDataAddress
+	}
+	values, err := s.ReadInput(register, numRegs)
+	if err != nil {
 		return []byte{}, &IllegalDataAddress
 	}
-	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(s.InputRegisters[register:endRegister])...), &Success
+	return append([]byte{byte(numRegs * 2)}, Uint16ToBytes(values)...), &Success
 }
 
-// WriteSingleCoil function 5, write a coil to internal memory.
+// WriteSingleCoil function 5, write a coil to internal memory. The value
+// must be 0x0000 (off) or 0xFF00 (on).
 func WriteSingleCoil(s *Server, frame Framer) ([]byte, *Exception) {
+	if len(frame.GetData()) != 4 {
+		return []byte{}, &IllegalDataValue
+	}
 	register, value := registerAddressAndValue(frame)
-	// TODO Should we use 0 for off and 65,280 (FF00 in hexadecimal) for on?
-	if value != 0 {
-		value = 1
+	if value != coilOff && value != coilOn {
+		return []byte{}, &IllegalDataValue
 	}
-	s.Coils[register] = byte(value)
+	if !s.mapped(Coils, uint16(register), 1, true) {
+		return []byte{}, &IllegalDataAddress
+	}
+	s.WriteCoils(uint16(register), []bool{value == coilOn})
 	return frame.GetData()[0:4], &Success
 }
 
 // WriteHoldingRegister function 6, write a holding register to internal memory.
 func WriteHoldingRegister(s *Server, frame Framer) ([]byte, *Exception) {
+	if len(frame.GetData()) != 4 {
+		return []byte{}, &IllegalDataValue
+	}
 	register, value := registerAddressAndValue(frame)
-	s.HoldingRegisters[register] = value
+	if !s.mapped(HoldingRegisters, uint16(register), 1, true) {
+		return []byte{}, &IllegalDataAddress
+	}
+	s.WriteHolding(uint16(register), []uint16{value})
 	return frame.GetData()[0:4], &Success
 }
 
 // WriteMultipleCoils function 15, writes holding registers to internal memory.
 func WriteMultipleCoils(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, endRegister := registerAddressAndNumber(frame)
-	valueBytes := frame.GetData()[5:]
-
-	if endRegister > 65536 {
-		return []byte{}, &IllegalDataAddress
+	register, numRegs, valueBytes, exception := writeMultipleRequest(frame, maxWriteBits, true)
+	if exception != &Success {
+		return []byte{}, exception
 	}
 
-	// TODO This is not correct, bits and bytes do not always align
-	//if len(valueBytes)/2 != numRegs {
-	//	return []byte{}, &IllegalDataAddress
-	//}
-
-	bitCount := 0
-	for i, value := range valueBytes {
-		for bitPos := uint(0); bitPos < 8; bitPos++ {
-			s.Coils[register+(i*8)+int(bitPos)] = bitAtPosition(value, bitPos)
-			bitCount++
-			if bitCount >= numRegs {
-				break
-			}
-		}
-		if bitCount >= numRegs {
-			break
+	values := make([]bool, 0, numRegs)
+	for _, value := range valueBytes {
+		for bitPos := uint(0); bitPos < 8 && len(values) < numRegs; bitPos++ {
+			values = append(values, bitAtPosition(value, bitPos) != 0)
 		}
 	}
+	if !s.mapped(Coils, register, numRegs, true) {
+		return []byte{}, &IllegalDataAddress
+	}
+	if err := s.WriteCoils(register, values); err != nil {
+		return []byte{}, &IllegalDataAddress
+	}
 
 	return frame.GetData()[0:4], &Success
 }
 
 // WriteHoldingRegisters function 16, writes holding registers to internal memory.
 func WriteHoldingRegisters(s *Server, frame Framer) ([]byte, *Exception) {
-	register, numRegs, _ := registerAddressAndNumber(frame)
-	valueBytes := frame.GetData()[5:]
-	var exception *Exception
-	var data []byte
-
-	if len(valueBytes)/2 != numRegs {
-		exception = &IllegalDataAddress
+	register, numRegs, valueBytes, exception := writeMultipleRequest(frame, maxWriteRegisters, false)
+	if exception != &Success {
+		return []byte{}, exception
 	}
 
 	// Copy data to memroy
 	values := BytesToUint16(valueBytes)
-	valuesUpdated := copy(s.HoldingRegisters[register:], values)
-	if valuesUpdated == numRegs {
-		exception = &Success
-		data = frame.GetData()[0:4]
-	} else {
-		exception = &IllegalDataAddress
+	if !s.mapped(HoldingRegisters, register, numRegs, true) {
+		return []byte{}, &IllegalDataAddress
+	}
+	if err := s.WriteHolding(register, values); err != nil {
+		return []byte{}, &IllegalDataAddress
 	}
 
-	return data, exception
+	return frame.GetData()[0:4], &Success
+}
+
+// MaskWriteRegister function 22, modifies a holding register in internal
+// memory using an AND mask and an OR mask.
+func MaskWriteRegister(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) != 6 {
+		return []byte{}, &IllegalDataValue
+	}
+	register := binary.BigEndian.Uint16(data[0:2])
+	andMask := binary.BigEndian.Uint16(data[2:4])
+	orMask := binary.BigEndian.Uint16(data[4:6])
+	if !s.mapped(HoldingRegisters, register, 1, true) {
+		return []byte{}, &IllegalDataAddress
+	}
+
+	err := s.Transaction(func(m *Memory) error {
+		current, err := m.ReadHolding(register, 1)
+		if err != nil {
+			return err
+		}
+		return m.WriteHolding(register, []uint16{(current[0] & andMask) | (orMask &^ andMask)})
+	})
+	if err != nil {
+		return []byte{}, &IllegalDataAddress
+	}
+	return data[0:6], &Success
+}
+
+// ReadWriteMultipleRegisters function 23, writes holding registers to
+// internal memory and then reads holding registers from internal memory.
+func ReadWriteMultipleRegisters(s *Server, frame Framer) ([]byte, *Exception) {
+	data := frame.GetData()
+	if len(data) < 9 {
+		return []byte{}, &IllegalDataValue
+	}
+	readRegister := binary.BigEndian.Uint16(data[0:2])
+	readNumRegs := int(binary.BigEndian.Uint16(data[2:4]))
+	writeRegister := binary.BigEndian.Uint16(data[4:6])
+	writeNumRegs := int(binary.BigEndian.Uint16(data[6:8]))
+	byteCount := int(data[8])
+	valueBytes := data[9:]
+
+	if readNumRegs < 1 || readNumRegs > 125 || writeNumRegs < 1 || writeNumRegs > 121 ||
+		byteCount != writeNumRegs*2 || len(valueBytes) != byteCount {
+		return []byte{}, &IllegalDataValue
+	}
+	if !s.mapped(HoldingRegisters, readRegister, readNumRegs, false) ||
+		!s.mapped(HoldingRegisters, writeRegister, writeNumRegs, true) {
+		return []byte{}, &IllegalDataAddress
+	}
+
+	// The write is performed before the read.
+	var values []uint16
+	err := s.Transaction(func(m *Memory) error {
+		if err := checkRange(readRegister, readNumRegs); err != nil {
+			return err
+		}
+		if err := m.WriteHolding(writeRegister, BytesToUint16(valueBytes)); err != nil {
+			return err
+		}
+		var err error
+		values, err = m.ReadHolding(readRegister, readNumRegs)
+		return err
+	})
+	if err != nil {
+		return []byte{}, &IllegalDataAddress
+	}
+	return append([]byte{byte(readNumRegs * 2)}, Uint16ToBytes(values)...), &Success
 }
 
 // BytesToUint16 converts a big endian array of bytes to an array of unit16s
@@ -157,6 +277,24 @@ func Uint16ToBytes(values []uint16) []byte {
 	return bytes
 }
 
+// bitsToBytes packs bit values into a byte count followed by bytes holding
+// eight bits each, least significant bit first.
+func bitsToBytes(values []bool) []byte {
+	dataSize := len(values) / 8
+	if (len(values) % 8) != 0 {
+		dataSize++
+	}
+	data := make([]byte, 1+dataSize)
+	data[0] = byte(dataSize)
+	for i, value := range values {
+		if value {
+			shift := uint(i) % 8
+			data[1+i/8] |= byte(1 << shift)
+		}
+	}
+	return data
+}
+
 func bitAtPosition(value uint8, pos uint) uint8 {
 	return (value >> pos) & 0x01
 }
@@ -14,14 +14,19 @@ func isEqual(a interface{}, b interface{}) bool {
 	return true
 }
 
+// handleRequest passes a Modbus TCP request with the given function code and
+// data to the server, and returns the response or nil.
+func handleRequest(s *Server, function uint8, data []byte) Framer {
+	frame := &TCPFrame{TransactionIdentifier: 1, Device: 255, Function: function, Data: data}
+	return s.handle(&Request{frame: frame})
+}
+
 // Function 1
 func TestReadCoils(t *testing.T) {
 	s := NewServer()
 	// Set the coil values
-	s.Coils[10] = 1
-	s.Coils[11] = 1
-	s.Coils[17] = 1
-	s.Coils[18] = 1
+	s.WriteCoils(10, []bool{true, true})
+	s.WriteCoils(17, []bool{true, true})
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
@@ -52,10 +57,8 @@ func TestReadCoils(t *testing.T) {
 func TestReadDiscreteInputs(t *testing.T) {
 	s := NewServer()
 	// Set the discrete input values
-	s.DiscreteInputs[0] = 1
-	s.DiscreteInputs[7] = 1
-	s.DiscreteInputs[8] = 1
-	s.DiscreteInputs[9] = 1
+	s.WriteDiscrete(0, []bool{true})
+	s.WriteDiscrete(7, []bool{true, true, true})
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
@@ -84,9 +87,7 @@ func TestReadDiscreteInputs(t *testing.T) {
 // Function 3
 func TestReadHoldingRegisters(t *testing.T) {
 	s := NewServer()
-	s.HoldingRegisters[100] = 1
-	s.HoldingRegisters[101] = 2
-	s.HoldingRegisters[102] = 65535
+	s.WriteHolding(100, []uint16{1, 2, 65535})
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
@@ -114,9 +115,7 @@ func TestReadHoldingRegisters(t *testing.T) {
 // Function 4
 func TestReadInputRegisters(t *testing.T) {
 	s := NewServer()
-	s.InputRegisters[200] = 1
-	s.InputRegisters[201] = 2
-	s.InputRegisters[202] = 65535
+	s.WriteInput(200, []uint16{1, 2, 65535})
 
 	var frame TCPFrame
 	frame.TransactionIdentifier = 1
@@ -151,7 +150,7 @@ func TestWriteSingleCoil(t *testing.T) {
 	frame.Length = 12
 	frame.Device = 255
 	frame.Function = 5
-	SetDataWithRegisterAndNumber(&frame, 65535, 1024)
+	SetDataWithRegisterAndNumber(&frame, 65535, 0xFF00)
 
 	var req Request
 	req.frame = &frame
@@ -161,8 +160,8 @@ func TestWriteSingleCoil(t *testing.T) {
 		t.Errorf("expected Success, got %v", exception.String())
 		t.FailNow()
 	}
-	expect := 1
-	got := s.Coils[65535]
+	expect := []bool{true}
+	got, _ := s.ReadCoils(65535, 1)
 	if !isEqual(expect, got) {
 		t.Errorf("expected %v, got %v\n", expect, got)
 	}
@@ -188,8 +187,8 @@ func TestWriteHoldingRegister(t *testing.T) {
 		t.Errorf("expected Success, got %v", exception.String())
 		t.FailNow()
 	}
-	expect := 6
-	got := s.HoldingRegisters[5]
+	expect := []uint16{6}
+	got, _ := s.ReadHolding(5, 1)
 	if !isEqual(expect, got) {
 		t.Errorf("expected %v, got %v\n", expect, got)
 	}
@@ -215,8 +214,8 @@ func TestWriteMultipleCoils(t *testing.T) {
 		t.Errorf("expected Success, got %v", exception.String())
 		t.FailNow()
 	}
-	expect := []byte{1, 1}
-	got := s.Coils[1:3]
+	expect := []bool{true, true}
+	got, _ := s.ReadCoils(1, 2)
 	if !isEqual(expect, got) {
 		t.Errorf("expected %v, got %v\n", expect, got)
 	}
@@ -243,12 +242,216 @@ func TestWriteHoldingRegisters(t *testing.T) {
 		t.FailNow()
 	}
 	expect := []uint16{3, 4}
-	got := s.HoldingRegisters[1:3]
+	got, _ := s.ReadHolding(1, 2)
 	if !isEqual(expect, got) {
 		t.Errorf("expected %v, got %v\n", expect, got)
 	}
 }
 
+// Function 22
+func TestMaskWriteRegister(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(4, []uint16{0x12})
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Length = 8
+	frame.Device = 255
+	frame.Function = 22
+	// Example from the Modbus Application Protocol specification.
+	frame.Data = []byte{0, 4, 0, 0xf2, 0, 0x25}
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := []byte{0, 4, 0, 0xf2, 0, 0x25}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	expectValue := []uint16{0x17}
+	gotValue, _ := s.ReadHolding(4, 1)
+	if !isEqual(expectValue, gotValue) {
+		t.Errorf("expected %v, got %v\n", expectValue, gotValue)
+	}
+}
+
+func TestMaskWriteRegisterShortPDU(t *testing.T) {
+	s := NewServer()
+
+	var frame TCPFrame
+	frame.Function = 22
+	frame.Data = []byte{0, 4, 0, 0xf2}
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+}
+
+// Function 23
+func TestReadWriteMultipleRegisters(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(3, []uint16{1, 2})
+
+	var frame TCPFrame
+	frame.TransactionIdentifier = 1
+	frame.ProtocolIdentifier = 0
+	frame.Length = 17
+	frame.Device = 255
+	frame.Function = 23
+	// Read 3 registers from 3 after writing 2 registers from 5.
+	frame.Data = []byte{0, 3, 0, 3, 0, 5, 0, 2, 4, 0, 7, 0, 8}
+
+	var req Request
+	req.frame = &frame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+		t.FailNow()
+	}
+	expect := []byte{6, 0, 1, 0, 2, 0, 7}
+	got := response.GetData()
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	expectValues := []uint16{7, 8}
+	gotValues, _ := s.ReadHolding(5, 2)
+	if !isEqual(expectValues, gotValues) {
+		t.Errorf("expected %v, got %v\n", expectValues, gotValues)
+	}
+}
+
+func TestReadWriteMultipleRegistersInvalid(t *testing.T) {
+	s := NewServer()
+
+	var frame TCPFrame
+	frame.Function = 23
+
+	var req Request
+	req.frame = &frame
+
+	tests := []struct {
+		data   []byte
+		expect Exception
+	}{
+		// Short PDU.
+		{[]byte{0, 0, 0, 1, 0, 0, 0, 1}, IllegalDataValue},
+		// Read quantity of 0.
+		{[]byte{0, 0, 0, 0, 0, 0, 0, 1, 2, 0, 1}, IllegalDataValue},
+		// Read quantity above 125.
+		{[]byte{0, 0, 0, 126, 0, 0, 0, 1, 2, 0, 1}, IllegalDataValue},
+		// Write quantity above 121.
+		{append([]byte{0, 0, 0, 1, 0, 0, 0, 122, 244}, make([]byte, 244)...), IllegalDataValue},
+		// Byte count does not match the write quantity.
+		{[]byte{0, 0, 0, 1, 0, 0, 0, 1, 4, 0, 1}, IllegalDataValue},
+		// Values do not match the byte count.
+		{[]byte{0, 0, 0, 1, 0, 0, 0, 1, 2, 0}, IllegalDataValue},
+		// Read beyond the end of memory.
+		{[]byte{255, 255, 0, 2, 0, 0, 0, 1, 2, 0, 1}, IllegalDataAddress},
+		// Write beyond the end of memory.
+		{[]byte{0, 0, 0, 1, 255, 255, 0, 2, 4, 0, 1, 0, 2}, IllegalDataAddress},
+	}
+	for _, test := range tests {
+		frame.Data = test.data
+		response := s.handle(&req)
+		exception := GetException(response)
+		if exception != test.expect {
+			t.Errorf("%v: expected %v, got %v", test.data, test.expect.String(), exception.String())
+		}
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	s := NewServer()
+
+	var frame TCPFrame
+	frame.Device = 255
+	var req Request
+	req.frame = &frame
+
+	tests := []struct {
+		function uint8
+		data     []byte
+		expect   Exception
+	}{
+		{1, []byte{0, 0, 0}, IllegalDataValue},                                              // Short.
+		{1, []byte{0, 0, 0, 1, 0}, IllegalDataValue},                                        // Long.
+		{1, []byte{0, 0, 0, 0}, IllegalDataValue},                                           // No coils.
+		{2, []byte{0, 0, 0x07, 0xD1}, IllegalDataValue},                                     // 2001 inputs.
+		{2, []byte{0, 0, 0x07, 0xD0}, Success},                                              // 2000 inputs.
+		{3, []byte{0, 0, 0, 126}, IllegalDataValue},                                         // 126 registers.
+		{4, []byte{}, IllegalDataValue},                                                     // Empty.
+		{5, []byte{0, 0, 0, 1}, IllegalDataValue},                                           // Coil value 0x0001.
+		{5, []byte{0, 0, 0xFF, 0xFF}, IllegalDataValue},                                     // Coil value 0xFFFF.
+		{5, []byte{0, 0, 0, 0}, Success},                                                    // Coil off.
+		{6, []byte{0, 0, 0}, IllegalDataValue},                                              // Short.
+		{15, []byte{0, 0, 0, 9, 1, 0xFF}, IllegalDataValue},                                 // 9 coils in 1 byte.
+		{15, []byte{0, 0, 0, 8, 1}, IllegalDataValue},                                       // Missing values.
+		{15, []byte{0, 0, 0, 8, 1, 0xFF, 0}, IllegalDataValue},                              // Extra values.
+		{15, []byte{0, 0, 0, 9, 2, 0xFF, 1}, Success},                                       // 9 coils in 2 bytes.
+		{16, []byte{0, 0, 0, 1, 2, 0}, IllegalDataValue},                                    // Missing value byte.
+		{16, []byte{0, 0, 0, 2, 2, 0, 1}, IllegalDataValue},                                 // Byte count mismatch.
+		{16, []byte{0, 0, 0, 124, 248}, IllegalDataValue},                                   // 124 registers.
+		{16, []byte{0, 0}, IllegalDataValue},                                                // Short.
+		{16, []byte{0, 0, 0, 1, 2, 0, 1}, Success},                                          // One register.
+		{15, append([]byte{0, 0, 0x07, 0xB1, 247}, make([]byte, 247)...), IllegalDataValue}, // 1969 coils.
+	}
+	for _, test := range tests {
+		frame.Function = test.function
+		frame.SetData(test.data)
+		response := s.handle(&req)
+		if exception := GetException(response); exception != test.expect {
+			t.Errorf("function %v %v: expected %v, got %v", test.function, test.data, test.expect, exception)
+		}
+	}
+}
+
+// Every function code with truncated or garbage data must be answered
+// without a handler panicking.
+func TestMalformedRequestsDoNotPanic(t *testing.T) {
+	patterns := []byte{0x00, 0x01, 0x7F, 0xFF}
+	for function := 0; function < 256; function++ {
+		s := NewServer()
+		for _, pattern := range patterns {
+			for n := 0; n <= 12; n++ {
+				data := make([]byte, n)
+				for i := range data {
+					data[i] = pattern + byte(i)
+				}
+				frame := &TCPFrame{Device: 1, Function: uint8(function), Data: data}
+				response := s.handle(&Request{frame: frame})
+				if response != nil && GetException(response) == SlaveDeviceFailure {
+					t.Errorf("function %v data %v: handler panicked", function, data)
+				}
+			}
+		}
+	}
+}
+
+func TestHandlerPanicRecovered(t *testing.T) {
+	s := NewServer()
+	s.RegisterFunctionHandler(65, func(s *Server, frame Framer) ([]byte, *Exception) {
+		return frame.GetData()[10:], &Success
+	})
+
+	frame := &TCPFrame{Device: 1, Function: 65}
+	response := s.handle(&Request{frame: frame})
+	if exception := GetException(response); exception != SlaveDeviceFailure {
+		t.Errorf("expected SlaveDeviceFailure, got %v", exception)
+	}
+}
+
 func TestBytesToUint16(t *testing.T) {
 	bytes := []byte{1, 2, 3, 4}
 	got := BytesToUint16(bytes)
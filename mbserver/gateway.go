@@ -0,0 +1,72 @@
+package mbserver
+
+import "errors"
+
+// AddGatewayRoute forwards the requests for a unit identifier to a slave on
+// a downstream port, as a Modbus TCP to RTU gateway does. The downstream
+// client is typically opened with DialRTU or DialRTUTCP, and several unit
+// identifiers can share it. Its Timeout is the response timeout: a slave that
+// does not answer in time is reported with GatewayTargetDeviceFailedtoRespond,
+// and a downstream port that cannot be opened with GatewayPathUnavailable.
+// Routed unit identifiers take precedence over units added with AddUnit.
+// Unit identifiers with neither a route nor a unit are answered with
+// GatewayPathUnavailable, whatever UnknownUnits says.
+// Requests are forwarded by the server's handler, so other requests wait
+// while a slave is being polled, as on a real gateway.
+func (s *Server) AddGatewayRoute(unitID uint8, downstream *Client) {
+	s.gatewayMu.Lock()
+	defer s.gatewayMu.Unlock()
+	if s.gateway == nil {
+		s.gateway = make(map[uint8]*Client)
+	}
+	s.gateway[unitID] = downstream
+}
+
+// RemoveGatewayRoute stops forwarding the requests for a unit identifier.
+func (s *Server) RemoveGatewayRoute(unitID uint8) {
+	s.gatewayMu.Lock()
+	defer s.gatewayMu.Unlock()
+	delete(s.gateway, unitID)
+}
+
+// gatewayRoute returns the downstream client of a unit identifier, or nil,
+// and whether the server has any gateway routes.
+func (s *Server) gatewayRoute(unitID uint8) (*Client, bool) {
+	s.gatewayMu.RLock()
+	defer s.gatewayMu.RUnlock()
+	return s.gateway[unitID], len(s.gateway) > 0
+}
+
+// forward sends a request to its downstream slave and returns the response
+// in the framing of the request, or nil for broadcasts. Faults of the server
+// apply to forwarded requests too.
+func (s *Server) forward(request *Request, downstream *Client) Framer {
+	request.fault = s.pickFault(request.frame)
+	if exception := request.fault.exception(); exception != nil {
+		response := request.frame.Copy()
+		response.SetException(exception)
+		return response
+	}
+
+	reply, err := downstream.Send(request.frame)
+	if err == nil && reply == nil {
+		return nil
+	}
+
+	response := request.frame.Copy()
+	var exception Exception
+	var connect *connectError
+	switch {
+	case err == nil:
+		response.SetData(reply.GetData())
+	case errors.As(err, &exception):
+		response.SetException(&exception)
+	case errors.As(err, &connect):
+		s.logf("gateway path to unit %d unavailable: %v\n", request.frame.GetUnitID(), err)
+		response.SetException(&GatewayPathUnavailable)
+	default:
+		s.logf("gateway target unit %d failed to respond: %v\n", request.frame.GetUnitID(), err)
+		response.SetException(&GatewayTargetDeviceFailedtoRespond)
+	}
+	return response
+}
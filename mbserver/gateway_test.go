@@ -0,0 +1,84 @@
+package mbserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	slave := NewServer()
+	defer slave.Close()
+	slave.WriteHolding(5, []uint16{99})
+	slaveAddr := getFreePort()
+	if err := slave.ListenRTUTCP(slaveAddr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	gateway := NewServer()
+	defer gateway.Close()
+	gateway.Logger = &testLogger{}
+	gateway.AddUnit(5).WriteHolding(5, []uint16{55})
+	gatewayAddr := getFreePort()
+	if err := gateway.ListenTCP(gatewayAddr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	downstream, err := DialRTUTCP(slaveAddr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer downstream.Close()
+	downstream.Timeout = 200 * time.Millisecond
+	downstream.Retries = 1
+	gateway.AddGatewayRoute(3, downstream)
+	gateway.AddGatewayRoute(9, downstream)
+
+	master, err := DialTCP(gatewayAddr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer master.Close()
+
+	registers, err := master.ReadHoldingRegisters(3, 5, 1)
+	if err != nil || !isEqual([]uint16{99}, registers) {
+		t.Errorf("expected %v, got %v %v", []uint16{99}, registers, err)
+	}
+	if err := master.WriteSingleRegister(3, 6, 7); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if registers, _ := slave.ReadHolding(6, 1); !isEqual([]uint16{7}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{7}, registers)
+	}
+
+	// Exceptions of the slave are passed on.
+	if _, err := master.ReadHoldingRegisters(3, 65535, 2); err != IllegalDataAddress {
+		t.Errorf("expected %v, got %v", IllegalDataAddress, err)
+	}
+
+	// Units without a route have no path, even when unknown units are
+	// served, but units of the gateway answer.
+	if _, err := master.ReadHoldingRegisters(4, 5, 1); err != GatewayPathUnavailable {
+		t.Errorf("expected %v, got %v", GatewayPathUnavailable, err)
+	}
+	if registers, err := master.ReadHoldingRegisters(5, 5, 1); err != nil || !isEqual([]uint16{55}, registers) {
+		t.Errorf("expected %v, got %v %v", []uint16{55}, registers, err)
+	}
+
+	// A slave that does not answer in time.
+	slave.SetFaults(Fault{Action: DropResponse, Probability: 1})
+	if _, err := master.ReadHoldingRegisters(3, 5, 1); err != GatewayTargetDeviceFailedtoRespond {
+		t.Errorf("expected %v, got %v", GatewayTargetDeviceFailedtoRespond, err)
+	}
+	slave.SetFaults()
+
+	// A downstream port that cannot be reached.
+	slave.Close()
+	if _, err := master.ReadHoldingRegisters(3, 5, 1); err != GatewayPathUnavailable {
+		t.Errorf("expected %v, got %v", GatewayPathUnavailable, err)
+	}
+
+	gateway.RemoveGatewayRoute(3)
+	if _, err := master.ReadHoldingRegisters(3, 5, 1); err != GatewayPathUnavailable {
+		t.Errorf("expected %v, got %v", GatewayPathUnavailable, err)
+	}
+}
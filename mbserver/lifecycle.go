@@ -0,0 +1,199 @@
+package mbserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and the Listen methods once the
+// server has been shut down.
+var ErrServerClosed = errors.New("mbserver: server closed")
+
+// errUnitListen is returned by the Listen methods of units, whose requests
+// are received by the server they were added to.
+var errUnitListen = errors.New("mbserver: units cannot listen, the server they were added to does")
+
+// isClosedError reports whether err comes from using a listener or
+// connection after closing it, as happens at shutdown.
+func isClosedError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// listen starts serve in a goroutine that Shutdown waits for, and closes c
+// at shutdown. Listeners are closed before in-flight requests are drained,
+// serial ports and UDP sockets, which responses are written to, after.
+// serve's error, other than from closing c, stops Serve.
+func (s *Server) listen(c io.Closer, serve func() error) error {
+	if s.parent != nil {
+		c.Close()
+		return errUnitListen
+	}
+
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if s.closing {
+		c.Close()
+		return ErrServerClosed
+	}
+
+	if listener, ok := c.(net.Listener); ok {
+		s.listeners = append(s.listeners, listener)
+	} else {
+		s.ports = append(s.ports, c)
+	}
+	s.goroutines.Add(1)
+	go func() {
+		defer s.goroutines.Done()
+		if err := serve(); err != nil {
+			s.fail(err)
+		}
+	}()
+	return nil
+}
+
+// serveConn runs serve for an accepted client connection in a goroutine that
+// Shutdown waits for, unless MaxClients rejects it. The connection is closed
+// when serve returns, when it is evicted or idle, or at shutdown once
+// in-flight requests have been answered.
+func (s *Server) serveConn(conn net.Conn, serve func(net.Conn)) {
+	s.lifeMu.Lock()
+	if s.closing {
+		s.lifeMu.Unlock()
+		conn.Close()
+		return
+	}
+	if s.admitConn(conn) == nil {
+		s.lifeMu.Unlock()
+		conn.Close()
+		return
+	}
+	s.goroutines.Add(1)
+	s.lifeMu.Unlock()
+
+	go func() {
+		defer s.goroutines.Done()
+		defer func() {
+			s.lifeMu.Lock()
+			s.removeConn(conn)
+			s.lifeMu.Unlock()
+			conn.Close()
+		}()
+		serve(conn)
+	}()
+}
+
+// submit passes a request to the handler. It returns false, dropping the
+// request, once the server is shutting down.
+func (s *Server) submit(request *Request) bool {
+	s.lifeMu.Lock()
+	if s.closing {
+		s.lifeMu.Unlock()
+		return false
+	}
+	s.inFlight.Add(1)
+	request.received = time.Now()
+	s.countRequest(request)
+	s.lifeMu.Unlock()
+
+	select {
+	case s.requestChan <- request:
+		return true
+	case <-s.done:
+		s.inFlight.Done()
+		return false
+	}
+}
+
+// fail stops Serve with the error of a listener.
+func (s *Server) fail(err error) {
+	select {
+	case s.failed <- err:
+	default:
+	}
+}
+
+// Serve blocks until ctx is done, Shutdown or Close is called, or a listener
+// fails, and shuts the server down gracefully. It returns ErrServerClosed
+// after Shutdown or Close, otherwise the error of ctx or of the listener.
+// The listeners are started with the Listen methods, before or while Serve
+// runs.
+func (s *Server) Serve(ctx context.Context) error {
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-s.failed:
+	case <-s.done:
+		return ErrServerClosed
+	}
+	s.Shutdown(context.Background())
+	return err
+}
+
+// Shutdown stops the server gracefully: listeners are closed, requests
+// already received are answered, and then client connections, serial ports
+// and the handler are stopped. It returns when all of the server's
+// goroutines have exited, or with the error of ctx if it is done first, in
+// which case connections are closed without waiting for in-flight requests.
+// A server that has been shut down cannot be started again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifeMu.Lock()
+	s.closing = true
+	listeners := s.listeners
+	s.listeners = nil
+	s.lifeMu.Unlock()
+
+	for _, listen := range listeners {
+		listen.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.lifeMu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	for _, port := range s.ports {
+		port.Close()
+	}
+	s.ports = nil
+	s.lifeMu.Unlock()
+	s.stopOnce.Do(func() { close(s.done) })
+
+	stopped := make(chan struct{})
+	go func() {
+		s.goroutines.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// Close stops listening to TCP/IP and UDP ports, closes client connections
+// and serial ports, and stops the handler, without waiting for in-flight
+// requests.
+func (s *Server) Close() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+}
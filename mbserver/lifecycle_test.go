@@ -0,0 +1,142 @@
+package mbserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// slowServer returns a listening server whose function 65 takes delay to
+// answer, signalling started when it begins.
+func slowServer(t *testing.T, delay time.Duration) (s *Server, addr string, started chan struct{}) {
+	t.Helper()
+	started = make(chan struct{}, 1)
+	s = NewServer()
+	s.RegisterFunctionHandler(65, func(s *Server, frame Framer) ([]byte, *Exception) {
+		started <- struct{}{}
+		time.Sleep(delay)
+		return []byte{1}, &Success
+	})
+	addr = getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	return s, addr, started
+}
+
+func dialSlowRequest(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	frame := &TCPFrame{TransactionIdentifier: 1, Device: 1, Function: 65, Data: []byte{0}}
+	if _, err := conn.Write(frame.Bytes()); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+	return conn
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	s, addr, started := slowServer(t, 50*time.Millisecond)
+	conn := dialSlowRequest(t, addr)
+	defer conn.Close()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+
+	// The in-flight request is answered before the connection is closed.
+	response := make([]byte, 9)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("failed to read response, got %v\n", err)
+	}
+	expect := []byte{0, 1, 0, 0, 0, 3, 1, 65, 1}
+	if !isEqual(expect, response) {
+		t.Errorf("expected %v, got %v", expect, response)
+	}
+	if _, err := conn.Read(response); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("expected the listener to be closed")
+	}
+	if err := s.ListenTCP(getFreePort()); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s, addr, started := slowServer(t, 500*time.Millisecond)
+	conn := dialSlowRequest(t, addr)
+	defer conn.Close()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	s, addr, _ := slowServer(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(ctx)
+	}()
+
+	conn := dialSlowRequest(t, addr)
+	defer conn.Close()
+	response := make([]byte, 9)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("failed to read response, got %v\n", err)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Errorf("expected Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for Serve to return")
+	}
+	if _, err := conn.Read(response); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// Serve returns ErrServerClosed when the server is closed elsewhere.
+	s = NewServer()
+	go s.Close()
+	if err := s.Serve(context.Background()); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestListenRTUReturnsError(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	err := s.ListenRTU(&serial.Config{Address: "/dev/mbserver-does-not-exist"})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestUnitCannotListen(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	if err := s.AddUnit(1).ListenTCP(getFreePort()); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
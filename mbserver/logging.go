@@ -0,0 +1,134 @@
+package mbserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Logger receives the messages of a server. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Transport is the transport and framing a request arrived with.
+type Transport string
+
+// Transports of the Listen methods.
+const (
+	TransportTCP      Transport = "tcp"
+	TransportTLS      Transport = "tls"
+	TransportUDP      Transport = "udp"
+	TransportRTU      Transport = "rtu"
+	TransportRTUTCP   Transport = "rtu-tcp"
+	TransportASCII    Transport = "ascii"
+	TransportASCIITCP Transport = "ascii-tcp"
+)
+
+// TraceEvent describes a request handled by a server and its outcome.
+type TraceEvent struct {
+	Time      time.Time
+	Transport Transport
+	// Remote is the address of the master, nil on serial lines.
+	Remote   net.Addr
+	Unit     uint8
+	Function uint8
+	// Address and Quantity are the addresses accessed by requests of the
+	// functions that read and write the memory maps, the read range for
+	// Read/Write Multiple Registers. Quantity is 0 for other functions.
+	Address  uint16
+	Quantity int
+	// Exception is the exception answered, Success for a normal response.
+	Exception Exception
+	// Responded is false when no response was sent, for example for
+	// broadcasts, in listen only mode or because of an injected fault.
+	Responded bool
+	// Latency is the time from receiving the request to writing the
+	// response.
+	Latency time.Duration
+}
+
+func (e TraceEvent) String() string {
+	remote := "-"
+	if e.Remote != nil {
+		remote = e.Remote.String()
+	}
+	outcome := e.Exception.String()
+	if !e.Responded {
+		outcome = "no response"
+	}
+	return fmt.Sprintf("%v %v unit %d function %d address %d quantity %d: %v in %v",
+		e.Transport, remote, e.Unit, e.Function, e.Address, e.Quantity, outcome, e.Latency)
+}
+
+// logf logs a message with the Logger of the server, or of the server it is
+// a unit of, or with the log package if there is none.
+func (s *Server) logf(format string, v ...interface{}) {
+	for s.parent != nil {
+		s = s.parent
+	}
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// transport returns the transport a request arrived with.
+func transport(request *Request) Transport {
+	_, network := request.conn.(net.Conn)
+	switch request.frame.(type) {
+	case *TCPFrame:
+		switch request.conn.(type) {
+		case *secureConn:
+			return TransportTLS
+		case *udpConn:
+			return TransportUDP
+		}
+		return TransportTCP
+	case *RTUFrame:
+		if network {
+			return TransportRTUTCP
+		}
+		return TransportRTU
+	case *ASCIIFrame:
+		if network {
+			return TransportASCIITCP
+		}
+		return TransportASCII
+	}
+	return ""
+}
+
+// trace reports a handled request to the Trace hook, and logs it in Debug
+// mode.
+func (s *Server) trace(request *Request, response Framer, responded bool) {
+	if s.Trace == nil && !s.Debug {
+		return
+	}
+
+	event := TraceEvent{
+		Time:      request.received,
+		Transport: transport(request),
+		Remote:    remoteAddr(request.conn),
+		Unit:      request.frame.GetUnitID(),
+		Function:  request.frame.GetFunction(),
+		Responded: responded && response != nil,
+		Latency:   time.Since(request.received),
+	}
+	if ranges := requestAddressRanges(request.frame); len(ranges) > 0 {
+		event.Address = ranges[0].Start
+		event.Quantity = ranges[0].Quantity
+	}
+	if response != nil {
+		event.Exception = GetException(response)
+	}
+
+	if s.Trace != nil {
+		s.Trace(event)
+	}
+	if s.Debug {
+		s.logf("%v\n", event)
+	}
+}
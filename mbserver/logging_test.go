@@ -0,0 +1,112 @@
+package mbserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogger records the messages logged by a server.
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, message := range l.messages {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTrace(t *testing.T) {
+	logger := &testLogger{}
+	events := make(chan TraceEvent, 4)
+	s := NewServer()
+	s.Logger = logger
+	s.Debug = true
+	s.Trace = func(event TraceEvent) {
+		events <- event
+	}
+	defer s.Close()
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	frame := &TCPFrame{Device: 7, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 5, 2)
+	conn.Write(frame.Bytes())
+	io.ReadFull(conn, make([]byte, 13))
+	frame.Function = 100
+	conn.Write(frame.Bytes())
+	io.ReadFull(conn, make([]byte, 9))
+
+	event := <-events
+	if event.Transport != TransportTCP || event.Remote.String() != conn.LocalAddr().String() ||
+		event.Unit != 7 || event.Function != 3 || event.Address != 5 || event.Quantity != 2 ||
+		event.Exception != Success || !event.Responded || event.Latency <= 0 || event.Time.IsZero() {
+		t.Errorf("unexpected trace %+v", event)
+	}
+	event = <-events
+	if event.Function != 100 || event.Exception != IllegalFunction || event.Quantity != 0 {
+		t.Errorf("unexpected trace %+v", event)
+	}
+
+	if !logger.contains("tcp " + conn.LocalAddr().String() + " unit 7 function 3 address 5 quantity 2: Success") {
+		t.Errorf("expected a debug trace, got %v", logger.messages)
+	}
+
+	// Errors go to the logger too.
+	conn.Write([]byte{0, 0, 0, 0, 0, 0, 0})
+	time.Sleep(10 * time.Millisecond)
+	if !logger.contains("read error") {
+		t.Errorf("expected a read error, got %v", logger.messages)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	port := newFakePort()
+
+	tests := []struct {
+		request *Request
+		expect  Transport
+	}{
+		{&Request{conn: server, frame: &TCPFrame{}}, TransportTCP},
+		{&Request{conn: &secureConn{Conn: server}, frame: &TCPFrame{}}, TransportTLS},
+		{&Request{conn: &udpConn{}, frame: &TCPFrame{}}, TransportUDP},
+		{&Request{conn: port, frame: &RTUFrame{}}, TransportRTU},
+		{&Request{conn: server, frame: &RTUFrame{}}, TransportRTUTCP},
+		{&Request{conn: port, frame: &ASCIIFrame{}}, TransportASCII},
+		{&Request{conn: server, frame: &ASCIIFrame{}}, TransportASCIITCP},
+	}
+	for _, test := range tests {
+		if got := transport(test.request); got != test.expect {
+			t.Errorf("expected %v, got %v", test.expect, got)
+		}
+	}
+}
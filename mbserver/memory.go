@@ -0,0 +1,204 @@
+package mbserver
+
+// memorySize is the number of coils, discrete inputs, holding registers and
+// input registers a server holds.
+const memorySize = 65536
+
+// Memory holds the Modbus memory maps of a server. It is only handed out by
+// Server.Transaction, the Server methods of the same names lock the memory
+// for every call.
+type Memory struct {
+	discreteInputs   []byte
+	coils            []byte
+	holdingRegisters []uint16
+	inputRegisters   []uint16
+	// journal holds the undo functions of the writes made in a transaction.
+	journal       []func()
+	inTransaction bool
+}
+
+func newMemory() Memory {
+	return Memory{
+		discreteInputs:   make([]byte, memorySize),
+		coils:            make([]byte, memorySize),
+		holdingRegisters: make([]uint16, memorySize),
+		inputRegisters:   make([]uint16, memorySize),
+	}
+}
+
+// checkRange returns IllegalDataAddress if n entries from address do not fit
+// in a memory map.
+func checkRange(address uint16, n int) error {
+	if n < 0 || int(address)+n > memorySize {
+		return IllegalDataAddress
+	}
+	return nil
+}
+
+func readBits(table []byte, address uint16, n int) ([]bool, error) {
+	if err := checkRange(address, n); err != nil {
+		return nil, err
+	}
+	values := make([]bool, n)
+	for i, value := range table[address : int(address)+n] {
+		values[i] = value != 0
+	}
+	return values, nil
+}
+
+func (m *Memory) writeBits(table []byte, address uint16, values []bool) error {
+	if err := checkRange(address, len(values)); err != nil {
+		return err
+	}
+	if m.inTransaction {
+		old := append([]byte{}, table[address:int(address)+len(values)]...)
+		m.journal = append(m.journal, func() { copy(table[address:], old) })
+	}
+	for i, value := range values {
+		var bit byte
+		if value {
+			bit = 1
+		}
+		table[int(address)+i] = bit
+	}
+	return nil
+}
+
+func readRegisters(table []uint16, address uint16, n int) ([]uint16, error) {
+	if err := checkRange(address, n); err != nil {
+		return nil, err
+	}
+	return append([]uint16{}, table[address:int(address)+n]...), nil
+}
+
+func (m *Memory) writeRegisters(table []uint16, address uint16, values []uint16) error {
+	if err := checkRange(address, len(values)); err != nil {
+		return err
+	}
+	if m.inTransaction {
+		old := append([]uint16{}, table[address:int(address)+len(values)]...)
+		m.journal = append(m.journal, func() { copy(table[address:], old) })
+	}
+	copy(table[address:], values)
+	return nil
+}
+
+// ReadCoils returns n coils starting at address.
+func (m *Memory) ReadCoils(address uint16, n int) ([]bool, error) {
+	return readBits(m.coils, address, n)
+}
+
+// WriteCoils sets coils starting at address.
+func (m *Memory) WriteCoils(address uint16, values []bool) error {
+	return m.writeBits(m.coils, address, values)
+}
+
+// ReadDiscrete returns n discrete inputs starting at address.
+func (m *Memory) ReadDiscrete(address uint16, n int) ([]bool, error) {
+	return readBits(m.discreteInputs, address, n)
+}
+
+// WriteDiscrete sets discrete inputs starting at address.
+func (m *Memory) WriteDiscrete(address uint16, values []bool) error {
+	return m.writeBits(m.discreteInputs, address, values)
+}
+
+// ReadHolding returns n holding registers starting at address.
+func (m *Memory) ReadHolding(address uint16, n int) ([]uint16, error) {
+	return readRegisters(m.holdingRegisters, address, n)
+}
+
+// WriteHolding sets holding registers starting at address.
+func (m *Memory) WriteHolding(address uint16, values []uint16) error {
+	return m.writeRegisters(m.holdingRegisters, address, values)
+}
+
+// ReadInput returns n input registers starting at address.
+func (m *Memory) ReadInput(address uint16, n int) ([]uint16, error) {
+	return readRegisters(m.inputRegisters, address, n)
+}
+
+// WriteInput sets input registers starting at address.
+func (m *Memory) WriteInput(address uint16, values []uint16) error {
+	return m.writeRegisters(m.inputRegisters, address, values)
+}
+
+// Transaction runs fn with the memory maps locked, so that masters and other
+// goroutines see either none or all of its writes. If fn returns an error
+// its writes are undone and the error is returned.
+func (s *Server) Transaction(fn func(m *Memory) error) error {
+	s.memoryMu.Lock()
+	defer s.memoryMu.Unlock()
+
+	m := &s.memory
+	m.inTransaction = true
+	defer func() {
+		m.inTransaction = false
+		m.journal = nil
+	}()
+
+	if err := fn(m); err != nil {
+		for i := len(m.journal) - 1; i >= 0; i-- {
+			m.journal[i]()
+		}
+		return err
+	}
+	return nil
+}
+
+// ReadCoils returns n coils starting at address. An address range beyond the
+// memory map returns IllegalDataAddress.
+func (s *Server) ReadCoils(address uint16, n int) ([]bool, error) {
+	s.memoryMu.RLock()
+	defer s.memoryMu.RUnlock()
+	return s.memory.ReadCoils(address, n)
+}
+
+// WriteCoils sets coils starting at address.
+func (s *Server) WriteCoils(address uint16, values []bool) error {
+	s.memoryMu.Lock()
+	defer s.memoryMu.Unlock()
+	return s.memory.WriteCoils(address, values)
+}
+
+// ReadDiscrete returns n discrete inputs starting at address.
+func (s *Server) ReadDiscrete(address uint16, n int) ([]bool, error) {
+	s.memoryMu.RLock()
+	defer s.memoryMu.RUnlock()
+	return s.memory.ReadDiscrete(address, n)
+}
+
+// WriteDiscrete sets discrete inputs starting at address.
+func (s *Server) WriteDiscrete(address uint16, values []bool) error {
+	s.memoryMu.Lock()
+	defer s.memoryMu.Unlock()
+	return s.memory.WriteDiscrete(address, values)
+}
+
+// ReadHolding returns n holding registers starting at address.
+func (s *Server) ReadHolding(address uint16, n int) ([]uint16, error) {
+	s.memoryMu.RLock()
+	defer s.memoryMu.RUnlock()
+	return s.memory.ReadHolding(address, n)
+}
+
+// WriteHolding sets holding registers starting at address.
+func (s *Server) WriteHolding(address uint16, values []uint16) error {
+	s.memoryMu.Lock()
+	defer s.memoryMu.Unlock()
+	return s.memory.WriteHolding(address, values)
+}
+
+// ReadInput returns n input registers starting at address.
+func (s *Server) ReadInput(address uint16, n int) ([]uint16, error) {
+	s.memoryMu.RLock()
+	defer s.memoryMu.RUnlock()
+	return s.memory.ReadInput(address, n)
+}
+
+// WriteInput sets input registers starting at address.
+func (s *Server) WriteInput(address uint16, values []uint16) error {
+	s.memoryMu.Lock()
+	defer s.memoryMu.Unlock()
+	return s.memory.WriteInput(address, values)
+}
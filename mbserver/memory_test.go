@@ -0,0 +1,140 @@
+package mbserver
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestMemoryAccessors(t *testing.T) {
+	s := NewServer()
+
+	if err := s.WriteCoils(65534, []bool{true, false}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	coils, err := s.ReadCoils(65534, 2)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []bool{true, false}
+	if !isEqual(expect, coils) {
+		t.Errorf("expected %v, got %v", expect, coils)
+	}
+
+	if err := s.WriteInput(10, []uint16{1, 2}); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	registers, err := s.ReadInput(10, 2)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expectRegisters := []uint16{1, 2}
+	if !isEqual(expectRegisters, registers) {
+		t.Errorf("expected %v, got %v", expectRegisters, registers)
+	}
+
+	// Changing the returned values does not change the memory.
+	registers[0] = 100
+	registers, _ = s.ReadInput(10, 2)
+	if !isEqual(expectRegisters, registers) {
+		t.Errorf("expected %v, got %v", expectRegisters, registers)
+	}
+}
+
+func TestMemoryAccessorsOutOfBounds(t *testing.T) {
+	s := NewServer()
+
+	if err := s.WriteHolding(65535, []uint16{1, 2}); err != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", err)
+	}
+	if _, err := s.ReadDiscrete(65535, 2); err != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", err)
+	}
+	if _, err := s.ReadHolding(0, -1); err != IllegalDataAddress {
+		t.Errorf("expected IllegalDataAddress, got %v", err)
+	}
+
+	// A failed write changes nothing.
+	values, _ := s.ReadHolding(65535, 1)
+	expect := []uint16{0}
+	if !isEqual(expect, values) {
+		t.Errorf("expected %v, got %v", expect, values)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{1, 2})
+
+	err := s.Transaction(func(m *Memory) error {
+		values, err := m.ReadHolding(0, 2)
+		if err != nil {
+			return err
+		}
+		return m.WriteHolding(0, []uint16{values[1], values[0]})
+	})
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	values, _ := s.ReadHolding(0, 2)
+	expect := []uint16{2, 1}
+	if !isEqual(expect, values) {
+		t.Errorf("expected %v, got %v", expect, values)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{1, 2})
+	s.WriteCoils(0, []bool{true})
+
+	failed := errors.New("failed")
+	err := s.Transaction(func(m *Memory) error {
+		m.WriteHolding(0, []uint16{3})
+		m.WriteHolding(1, []uint16{4})
+		m.WriteHolding(0, []uint16{5})
+		m.WriteCoils(0, []bool{false})
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("expected %v, got %v", failed, err)
+	}
+
+	values, _ := s.ReadHolding(0, 2)
+	expect := []uint16{1, 2}
+	if !isEqual(expect, values) {
+		t.Errorf("expected %v, got %v", expect, values)
+	}
+	coils, _ := s.ReadCoils(0, 1)
+	expectCoils := []bool{true}
+	if !isEqual(expectCoils, coils) {
+		t.Errorf("expected %v, got %v", expectCoils, coils)
+	}
+}
+
+func TestMemoryConcurrentAccess(t *testing.T) {
+	s := NewServer()
+
+	var frame TCPFrame
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 0, 2, []uint16{3, 4})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			var req Request
+			req.frame = &frame
+			s.handle(&req)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.WriteHolding(0, []uint16{uint16(i), uint16(i)})
+			s.ReadHolding(0, 2)
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,112 @@
+package mbserver
+
+import (
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+// RequestContext describes a request and the connection it arrived on, for
+// middleware.
+type RequestContext struct {
+	// Server is the server or unit answering the request.
+	Server *Server
+	// Frame is the request. Middleware can replace it with a modified copy
+	// for the handlers it calls.
+	Frame     Framer
+	Transport Transport
+	Unit      uint8
+	Function  uint8
+	// Remote and Local are the addresses of the master and of the server,
+	// nil on serial lines.
+	Remote net.Addr
+	Local  net.Addr
+	// Role and Certificate identify Modbus/TCP Security clients.
+	Role        string
+	Certificate *x509.Certificate
+	// Received is when the request was received.
+	Received time.Time
+
+	request *Request
+}
+
+// Handler answers a request with the response data, or with an exception
+// other than Success. The Exception variables of the package, for example
+// &Success, are returned.
+type Handler func(ctx *RequestContext) ([]byte, *Exception)
+
+// Middleware wraps a handler, for example to audit, authorize or delay
+// requests. It calls next to have the request answered, or answers it
+// itself.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware wrapping the handlers of every function code, including
+// function codes without a handler, which answer IllegalFunction. Middleware
+// added first is called first. The middleware of a server also wraps the
+// handlers of its units, around the units' own middleware.
+func (s *Server) Use(middleware ...Middleware) {
+	s.middlewareMu.Lock()
+	defer s.middlewareMu.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// UseFunction adds middleware wrapping the handler of one function code,
+// inside the middleware added with Use.
+func (s *Server) UseFunction(function uint8, middleware ...Middleware) {
+	s.middlewareMu.Lock()
+	defer s.middlewareMu.Unlock()
+	if s.functionMiddleware == nil {
+		s.functionMiddleware = make(map[uint8][]Middleware)
+	}
+	s.functionMiddleware[function] = append(s.functionMiddleware[function], middleware...)
+}
+
+// requestContext returns the context of a request answered by the server.
+func (s *Server) requestContext(request *Request) *RequestContext {
+	ctx := &RequestContext{
+		Server:    s,
+		Frame:     request.frame,
+		Transport: transport(request),
+		Unit:      request.frame.GetUnitID(),
+		Function:  request.frame.GetFunction(),
+		Remote:    remoteAddr(request.conn),
+		Received:  request.received,
+		request:   request,
+	}
+	if c, ok := request.conn.(interface{ LocalAddr() net.Addr }); ok {
+		ctx.Local = c.LocalAddr()
+	}
+	if secure, ok := request.conn.(*secureConn); ok {
+		ctx.Role = secure.role
+		ctx.Certificate = secure.certificate
+	}
+	return ctx
+}
+
+// functionHandler returns the handler of a function code wrapped in the
+// middleware of the server and of the server it is a unit of.
+func (s *Server) functionHandler(function uint8) Handler {
+	handler := Handler(func(ctx *RequestContext) ([]byte, *Exception) {
+		if s.function[function] == nil {
+			return []byte{}, &IllegalFunction
+		}
+		request := *ctx.request
+		request.frame = ctx.Frame
+		return s.executeWithNotify(&request, s.function[function])
+	})
+	for server := s; server != nil; server = server.parent {
+		handler = server.wrap(function, handler)
+	}
+	return handler
+}
+
+// wrap wraps a handler in the server's middleware for a function code.
+func (s *Server) wrap(function uint8, handler Handler) Handler {
+	s.middlewareMu.RLock()
+	defer s.middlewareMu.RUnlock()
+	chain := append(append([]Middleware{}, s.middleware...), s.functionMiddleware[function]...)
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler
+}
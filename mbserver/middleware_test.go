@@ -0,0 +1,126 @@
+package mbserver
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	var contexts []RequestContext
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx *RequestContext) ([]byte, *Exception) {
+				mu.Lock()
+				calls = append(calls, name)
+				if name == "audit" {
+					contexts = append(contexts, *ctx)
+				}
+				mu.Unlock()
+				return next(ctx)
+			}
+		}
+	}
+
+	s := NewServer()
+	defer s.Close()
+	s.Use(record("audit"), record("second"))
+	s.UseFunction(3, record("read"))
+	unit := s.AddUnit(2)
+	unit.Use(record("unit"))
+	// Writes to holding registers are denied.
+	s.UseFunction(6, func(next Handler) Handler {
+		return func(ctx *RequestContext) ([]byte, *Exception) {
+			return []byte{}, &IllegalFunction
+		}
+	})
+	addr := getFreePort()
+	if err := s.ListenTCP(addr); err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	c, err := DialTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer c.Close()
+
+	s.WriteHolding(0, []uint16{5})
+	if registers, err := c.ReadHoldingRegisters(1, 0, 1); err != nil || !isEqual([]uint16{5}, registers) {
+		t.Errorf("expected %v, got %v %v", []uint16{5}, registers, err)
+	}
+	if err := c.WriteSingleRegister(1, 0, 6); err != IllegalFunction {
+		t.Errorf("expected %v, got %v", IllegalFunction, err)
+	}
+	if registers, _ := s.ReadHolding(0, 1); !isEqual([]uint16{5}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{5}, registers)
+	}
+	c.ReadHoldingRegisters(2, 0, 1)
+	// Function codes without a handler go through the middleware too.
+	frame := &TCPFrame{Device: 1, Function: 99}
+	frame.SetData([]byte{0})
+	if _, err := c.Send(frame); err != IllegalFunction {
+		t.Errorf("expected %v, got %v", IllegalFunction, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expect := []string{
+		"audit", "second", "read",
+		"audit", "second",
+		"audit", "second", "read", "unit",
+		"audit", "second",
+	}
+	if !isEqual(expect, calls) {
+		t.Errorf("expected %v, got %v", expect, calls)
+	}
+
+	ctx := contexts[0]
+	if ctx.Transport != TransportTCP || ctx.Unit != 1 || ctx.Function != 3 || ctx.Server != s {
+		t.Errorf("unexpected context %+v", ctx)
+	}
+	if ctx.Remote.String() != c.conn.(net.Conn).LocalAddr().String() || ctx.Local.String() != c.conn.(net.Conn).RemoteAddr().String() {
+		t.Errorf("expected %v > %v, got %v > %v", c.conn.(net.Conn).LocalAddr(), c.conn.(net.Conn).RemoteAddr(), ctx.Remote, ctx.Local)
+	}
+	if ctx.Received.IsZero() {
+		t.Errorf("expected the time the request was received")
+	}
+	if contexts[2].Server != unit {
+		t.Errorf("expected the unit to answer for unit 2")
+	}
+}
+
+func TestMiddlewareFrame(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.WriteHolding(0, []uint16{1, 2})
+	// Reads are shifted by one register.
+	s.UseFunction(3, func(next Handler) Handler {
+		return func(ctx *RequestContext) ([]byte, *Exception) {
+			frame := ctx.Frame.Copy()
+			SetDataWithRegisterAndNumber(frame, 1, 1)
+			ctx.Frame = frame
+			return next(ctx)
+		}
+	})
+	s.UseFunction(4, func(next Handler) Handler {
+		return func(ctx *RequestContext) ([]byte, *Exception) {
+			panic("middleware failure")
+		}
+	})
+	s.Logger = &testLogger{}
+
+	frame := &TCPFrame{TransactionIdentifier: 1, Device: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 0, 1)
+	expect := []byte{0, 1, 0, 0, 0, 5, 1, 3, 2, 0, 2}
+	if got := faultExchange(t, s, frame); !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	frame.Function = 4
+	expect = []byte{0, 1, 0, 0, 0, 3, 1, 0x84, 4}
+	if got := faultExchange(t, s, frame); !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
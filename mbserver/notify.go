@@ -0,0 +1,252 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Table identifies one of the Modbus memory maps.
+type Table int
+
+// Modbus memory maps.
+const (
+	Coils Table = iota + 1
+	DiscreteInputs
+	HoldingRegisters
+	InputRegisters
+)
+
+func (t Table) String() string {
+	switch t {
+	case Coils:
+		return "Coils"
+	case DiscreteInputs:
+		return "DiscreteInputs"
+	case HoldingRegisters:
+		return "HoldingRegisters"
+	case InputRegisters:
+		return "InputRegisters"
+	}
+	return "unknown"
+}
+
+// WriteEvent describes a write by a master to coils or holding registers.
+// Coil values are 0 or 1.
+type WriteEvent struct {
+	Unit     uint8
+	Table    Table
+	Address  uint16
+	Quantity int
+	Old      []uint16
+	New      []uint16
+	// Client is the address of the master, nil on serial lines.
+	Client net.Addr
+}
+
+// WriteHook is called before a master's write is applied, with New holding
+// the values that will be written. Returning an exception other than
+// Success rejects the write and the exception is sent to the master.
+type WriteHook func(event WriteEvent) *Exception
+
+// AddWriteHook adds a hook called before writes by masters. Hooks added to a
+// server are also called for writes to its units.
+func (s *Server) AddWriteHook(hook WriteHook) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	s.writeHooks = append(s.writeHooks, hook)
+}
+
+// Subscribe calls fn after every write by a master, until the returned
+// cancel function is called. fn is called from the request handler, so
+// masters wait for it to return. Subscriptions to a server also receive the
+// writes to its units.
+func (s *Server) Subscribe(fn func(event WriteEvent)) (cancel func()) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[int]func(WriteEvent))
+	}
+	id := s.nextSubscriber
+	s.nextSubscriber++
+	s.subscribers[id] = fn
+
+	return func() {
+		s.notifyMu.Lock()
+		defer s.notifyMu.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+// notifiers returns the write hooks and subscribers of the server and of
+// the server it is a unit of.
+func (s *Server) notifiers() (hooks []WriteHook, subscribers []func(WriteEvent)) {
+	for server := s; server != nil; server = server.parent {
+		server.notifyMu.RLock()
+		hooks = append(hooks, server.writeHooks...)
+		for _, fn := range server.subscribers {
+			subscribers = append(subscribers, fn)
+		}
+		server.notifyMu.RUnlock()
+	}
+	return hooks, subscribers
+}
+
+// writeRequest is the part of memory a request writes to.
+type writeRequest struct {
+	table   Table
+	address uint16
+	values  []uint16
+	// Mask Write Register works out the value from the current one.
+	masked  bool
+	andMask uint16
+	orMask  uint16
+}
+
+// decodeWriteRequest returns the write made by a request, if the function
+// writes to memory and the request is well formed.
+func decodeWriteRequest(frame Framer) (*writeRequest, bool) {
+	data := frame.GetData()
+	var write *writeRequest
+
+	switch frame.GetFunction() {
+	case 5:
+		if len(data) != 4 {
+			return nil, false
+		}
+		var value uint16
+		switch binary.BigEndian.Uint16(data[2:4]) {
+		case coilOff:
+		case coilOn:
+			value = 1
+		default:
+			return nil, false
+		}
+		write = &writeRequest{table: Coils, values: []uint16{value}}
+	case 6:
+		if len(data) != 4 {
+			return nil, false
+		}
+		write = &writeRequest{table: HoldingRegisters, values: BytesToUint16(data[2:4])}
+	case 15:
+		_, numRegs, valueBytes, exception := writeMultipleRequest(frame, maxWriteBits, true)
+		if exception != &Success {
+			return nil, false
+		}
+		values := make([]uint16, numRegs)
+		for i := range values {
+			values[i] = uint16(bitAtPosition(valueBytes[i/8], uint(i)%8))
+		}
+		write = &writeRequest{table: Coils, values: values}
+	case 16:
+		_, _, valueBytes, exception := writeMultipleRequest(frame, maxWriteRegisters, false)
+		if exception != &Success {
+			return nil, false
+		}
+		write = &writeRequest{table: HoldingRegisters, values: BytesToUint16(valueBytes)}
+	case 22:
+		if len(data) != 6 {
+			return nil, false
+		}
+		write = &writeRequest{
+			table:   HoldingRegisters,
+			values:  make([]uint16, 1),
+			masked:  true,
+			andMask: binary.BigEndian.Uint16(data[2:4]),
+			orMask:  binary.BigEndian.Uint16(data[4:6]),
+		}
+	case 23:
+		if len(data) < 9 {
+			return nil, false
+		}
+		numRegs := int(binary.BigEndian.Uint16(data[6:8]))
+		if len(data[9:]) != numRegs*2 {
+			return nil, false
+		}
+		write = &writeRequest{
+			table:   HoldingRegisters,
+			address: binary.BigEndian.Uint16(data[4:6]),
+			values:  BytesToUint16(data[9:]),
+		}
+		return write, checkRange(write.address, len(write.values)) == nil
+	default:
+		return nil, false
+	}
+
+	write.address = binary.BigEndian.Uint16(data[0:2])
+	return write, len(write.values) > 0 && checkRange(write.address, len(write.values)) == nil
+}
+
+// readTable returns n values of a memory map, coils as 0 or 1.
+func (s *Server) readTable(table Table, address uint16, n int) []uint16 {
+	var bits []bool
+	switch table {
+	case Coils:
+		bits, _ = s.ReadCoils(address, n)
+	case DiscreteInputs:
+		bits, _ = s.ReadDiscrete(address, n)
+	case HoldingRegisters:
+		values, _ := s.ReadHolding(address, n)
+		return values
+	case InputRegisters:
+		values, _ := s.ReadInput(address, n)
+		return values
+	}
+	values := make([]uint16, len(bits))
+	for i, bit := range bits {
+		if bit {
+			values[i] = 1
+		}
+	}
+	return values
+}
+
+// executeWithNotify runs a request that writes to memory, calling the write
+// hooks first and the subscribers after a successful write.
+func (s *Server) executeWithNotify(request *Request, function func(*Server, Framer) ([]byte, *Exception)) ([]byte, *Exception) {
+	hooks, subscribers := s.notifiers()
+	write, ok := decodeWriteRequest(request.frame)
+	if ok {
+		ok = s.mapped(write.table, write.address, len(write.values), true)
+	}
+	if !ok || (len(hooks) == 0 && len(subscribers) == 0) {
+		return function(s, request.frame)
+	}
+
+	event := WriteEvent{
+		Unit:     request.frame.GetUnitID(),
+		Table:    write.table,
+		Address:  write.address,
+		Quantity: len(write.values),
+		Old:      s.readTable(write.table, write.address, len(write.values)),
+		New:      write.values,
+		Client:   remoteAddr(request.conn),
+	}
+	if write.masked {
+		event.New = []uint16{(event.Old[0] & write.andMask) | (write.orMask &^ write.andMask)}
+	}
+
+	for _, hook := range hooks {
+		if exception := hook(event); exception != nil && *exception != Success {
+			return []byte{}, exception
+		}
+	}
+
+	data, exception := function(s, request.frame)
+	if exception != &Success {
+		return data, exception
+	}
+
+	event.New = s.readTable(write.table, write.address, len(write.values))
+	for _, fn := range subscribers {
+		fn(event)
+	}
+	return data, exception
+}
+
+// remoteAddr returns the remote address of a network connection, or nil.
+func remoteAddr(conn interface{}) net.Addr {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package mbserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+func TestSubscribe(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(1, []uint16{10, 20})
+
+	var events []WriteEvent
+	cancel := s.Subscribe(func(event WriteEvent) {
+		events = append(events, event)
+	})
+
+	var frame TCPFrame
+	frame.Device = 3
+	frame.Function = 16
+	SetDataWithRegisterAndNumberAndValues(&frame, 1, 2, []uint16{3, 4})
+
+	var req Request
+	req.frame = &frame
+	s.handle(&req)
+
+	expect := []WriteEvent{{
+		Unit:     3,
+		Table:    HoldingRegisters,
+		Address:  1,
+		Quantity: 2,
+		Old:      []uint16{10, 20},
+		New:      []uint16{3, 4},
+	}}
+	if !isEqual(expect, events) {
+		t.Errorf("expected %+v, got %+v", expect, events)
+	}
+
+	// Reads are not notified, and nothing is after cancel.
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 1, 2)
+	s.handle(&req)
+	cancel()
+	frame.Function = 6
+	SetDataWithRegisterAndNumber(&frame, 1, 5)
+	s.handle(&req)
+	if len(events) != 1 {
+		t.Errorf("expected 1 event, got %+v", events)
+	}
+}
+
+func TestSubscribeMaskWriteAndCoils(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(4, []uint16{0x12})
+
+	var events []WriteEvent
+	s.Subscribe(func(event WriteEvent) {
+		events = append(events, event)
+	})
+
+	var frame TCPFrame
+	var req Request
+	req.frame = &frame
+
+	frame.Function = 22
+	frame.Data = []byte{0, 4, 0, 0xf2, 0, 0x25}
+	s.handle(&req)
+
+	frame.Function = 15
+	SetDataWithRegisterAndNumberAndBytes(&frame, 8, 3, []byte{5})
+	s.handle(&req)
+
+	expect := []WriteEvent{{
+		Table:    HoldingRegisters,
+		Address:  4,
+		Quantity: 1,
+		Old:      []uint16{0x12},
+		New:      []uint16{0x17},
+	}, {
+		Table:    Coils,
+		Address:  8,
+		Quantity: 3,
+		Old:      []uint16{0, 0, 0},
+		New:      []uint16{1, 0, 1},
+	}}
+	if !isEqual(expect, events) {
+		t.Errorf("expected %+v, got %+v", expect, events)
+	}
+}
+
+func TestWriteHookVeto(t *testing.T) {
+	s := NewServer()
+	unit := s.AddUnit(1)
+
+	// Setpoints above 100 are rejected for every unit.
+	s.AddWriteHook(func(event WriteEvent) *Exception {
+		for _, value := range event.New {
+			if value > 100 {
+				return &IllegalDataValue
+			}
+		}
+		return nil
+	})
+
+	var frame TCPFrame
+	frame.Device = 1
+	frame.Function = 6
+
+	var req Request
+	req.frame = &frame
+
+	SetDataWithRegisterAndNumber(&frame, 0, 101)
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != IllegalDataValue {
+		t.Errorf("expected IllegalDataValue, got %v", exception.String())
+	}
+	values, _ := unit.ReadHolding(0, 1)
+	expect := []uint16{0}
+	if !isEqual(expect, values) {
+		t.Errorf("expected %v, got %v", expect, values)
+	}
+
+	SetDataWithRegisterAndNumber(&frame, 0, 100)
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+}
+
+func TestSubscribeClientAddress(t *testing.T) {
+	s := NewServer()
+	events := make(chan WriteEvent, 1)
+	s.Subscribe(func(event WriteEvent) {
+		events <- event
+	})
+
+	addr := getFreePort()
+	err := s.ListenTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	handler := modbus.NewTCPClientHandler(addr)
+	err = handler.Connect()
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer handler.Close()
+	client := modbus.NewClient(handler)
+
+	_, err = client.WriteSingleCoil(7, 0xFF00)
+	if err != nil {
+		t.Fatalf("expected nil, got %v\n", err)
+	}
+
+	select {
+	case event := <-events:
+		if _, ok := event.Client.(*net.TCPAddr); !ok {
+			t.Errorf("expected a TCP client address, got %v", event.Client)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the write event")
+	}
+}
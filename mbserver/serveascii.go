@@ -0,0 +1,121 @@
+package mbserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	"github.com/goburrow/serial"
+)
+
+// ListenASCII starts the Modbus server listening for ASCII frames on a
+// serial device.
+// For example:  err := s.ListenASCII(&serial.Config{Address: "/dev/ttyUSB0"})
+func (s *Server) ListenASCII(serialConfig *serial.Config) (err error) {
+	port, err := serial.Open(serialConfig)
+	if err != nil {
+		s.logf("failed to open %s: %v\n", serialConfig.Address, err)
+		return err
+	}
+	return s.listen(port, func() error {
+		s.acceptASCIIRequests(port)
+		return nil
+	})
+}
+
+// ListenASCIITCP starts the Modbus server in ASCII over TCP mode
+// listening on "address:port".
+func (s *Server) ListenASCIITCP(addressPort string) (err error) {
+	listen, err := net.Listen("tcp", addressPort)
+	if err != nil {
+		s.logf("Failed to Listen: %v\n", err)
+		return err
+	}
+	return s.listen(listen, func() error { return s.acceptASCIITCP(listen) })
+}
+
+// acceptASCIITCP will accept TCP connections carrying ASCII frames.
+func (s *Server) acceptASCIITCP(listen net.Listener) error {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			if isClosedError(err) {
+				return nil
+			}
+			s.logf("Unable to accept connections: %#v\n", err)
+			return err
+		}
+
+		s.serveConn(conn, func(conn net.Conn) {
+			s.acceptASCIIRequests(conn)
+		})
+	}
+}
+
+// acceptASCIIRequests reads ASCII frames from conn until it is closed.
+func (s *Server) acceptASCIIRequests(conn io.ReadWriteCloser) {
+	var buffer []byte
+	for {
+		packet := make([]byte, 512)
+		bytesRead, err := conn.Read(packet)
+		if err != nil {
+			// Serial read timeouts only mean that the line is idle.
+			if err == serial.ErrTimeout {
+				continue
+			}
+			if err != io.EOF && !isClosedError(err) {
+				s.logf("read error %v\n", err)
+			}
+			return
+		}
+
+		buffer = s.handleASCIIStream(conn, append(buffer, packet[:bytesRead]...))
+	}
+}
+
+// handleASCIIStream passes every ASCII frame in buffer to the handler and
+// returns the bytes of an incomplete frame. Once the server is shutting down
+// the remaining bytes are dropped. A ':' always starts a new frame,
+// so anything before it is dropped. Frames end with CR and the input
+// delimiter, LF unless changed with the Diagnostics function.
+func (s *Server) handleASCIIStream(conn io.ReadWriteCloser, buffer []byte) []byte {
+	delimiter := s.asciiDelimiter()
+	for {
+		start := bytes.IndexByte(buffer, ':')
+		if start < 0 {
+			return buffer[:0]
+		}
+		buffer = buffer[start:]
+
+		end := bytes.IndexByte(buffer, delimiter)
+		if end < 0 {
+			if len(buffer) > asciiMaxADULength {
+				s.logf("bad ascii frame error: no end of frame in %d bytes\n", len(buffer))
+				return buffer[:0]
+			}
+			return buffer
+		}
+
+		// Start again from a ':' received before the end of the frame.
+		if restart := bytes.LastIndexByte(buffer[:end], ':'); restart > 0 {
+			buffer = buffer[restart:]
+			continue
+		}
+
+		packet := buffer[:end+1]
+		buffer = buffer[end+1:]
+
+		frame, err := newASCIIFrame(packet, delimiter)
+		if err != nil {
+			s.logf("bad ascii frame error %v\n", err)
+			s.bus.countCommunicationError()
+			continue
+		}
+
+		request := &Request{conn: conn, frame: frame}
+
+		if !s.submit(request) {
+			return nil
+		}
+	}
+}
@@ -4,39 +4,128 @@ package mbserver
 import (
 	"io"
 	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UnknownUnitPolicy selects how a server answers requests addressed to a
+// unit identifier that has not been added with AddUnit.
+type UnknownUnitPolicy int
 
-	"github.com/goburrow/serial"
+const (
+	// ServeUnknownUnits answers the request from the server's own memory
+	// maps and function table. This is the default. A server with gateway
+	// routes rejects unknown units whatever the policy.
+	ServeUnknownUnits UnknownUnitPolicy = iota
+	// RejectUnknownUnits does not respond on serial lines (RTU) and answers
+	// with GatewayTargetDeviceFailedtoRespond over Modbus TCP, or with
+	// GatewayPathUnavailable if the server has gateway routes.
+	RejectUnknownUnits
 )
 
 // Server is a Modbus slave with allocated memory for discrete inputs, coils, etc.
+// The memory is accessed with the Read and Write methods, which are safe to
+// call while masters are connected.
 type Server struct {
-	// Debug enables more verbose messaging.
-	Debug            bool
-	listeners        []net.Listener
-	ports            []serial.Port
-	requestChan      chan *Request
-	function         [256](func(*Server, Framer) ([]byte, *Exception))
-	DiscreteInputs   []byte
-	Coils            []byte
-	HoldingRegisters []uint16
-	InputRegisters   []uint16
+	// Debug logs a trace of every request with the Logger.
+	Debug bool
+	// Logger receives the server's messages, the log package's standard
+	// logger if nil.
+	Logger Logger
+	// Trace is called with a trace of every request handled, after the
+	// response has been written.
+	Trace func(event TraceEvent)
+	// UnknownUnits selects how requests for unit identifiers without a unit
+	// added with AddUnit are answered.
+	UnknownUnits UnknownUnitPolicy
+	// SlaveAddress is the address the server answers on serial lines, for
+	// RTU and ASCII frames. When set, frames for other addresses without a
+	// unit are ignored, as by one of several slaves on an RS-485 bus,
+	// whatever UnknownUnits says. 0 leaves them to UnknownUnits. Address 0
+	// is always a broadcast: it is applied to the server and to every unit
+	// and never answered.
+	SlaveAddress uint8
+	// MaxClients limits the number of masters connected to the TCP
+	// listeners of the server, 0 for no limit. ClientLimit selects whether
+	// new connections are rejected or the oldest is closed at the limit.
+	// Like IdleTimeout they are set before listening.
+	MaxClients  int
+	ClientLimit ClientLimitPolicy
+	// IdleTimeout closes connections that have not received or answered a
+	// request for this long, 0 to keep them open.
+	IdleTimeout        time.Duration
+	lifeMu             sync.Mutex
+	closing            bool
+	listeners          []net.Listener
+	ports              []io.Closer
+	conns              map[net.Conn]*connection
+	goroutines         sync.WaitGroup
+	inFlight           sync.WaitGroup
+	done               chan struct{}
+	stopOnce           sync.Once
+	failed             chan error
+	requestChan        chan *Request
+	function           [256](func(*Server, Framer) ([]byte, *Exception))
+	unitsMu            sync.RWMutex
+	units              map[uint8]*Server
+	parent             *Server
+	deviceIDMu         sync.RWMutex
+	deviceID           map[uint8]string
+	filesMu            sync.RWMutex
+	files              map[uint16][]uint16
+	fifos              map[uint16][]uint16
+	diag               *diagnostics
+	bus                *diagnostics
+	memoryMu           sync.RWMutex
+	memory             Memory
+	addressMapMu       sync.RWMutex
+	addressMaps        map[Table][]AddressRange
+	faultsMu           sync.RWMutex
+	faults             []Fault
+	authorizeMu        sync.RWMutex
+	authorize          AuthorizationHook
+	middlewareMu       sync.RWMutex
+	middleware         []Middleware
+	functionMiddleware map[uint8][]Middleware
+	gatewayMu          sync.RWMutex
+	gateway            map[uint8]*Client
+	captureMu          sync.Mutex
+	capture            *capture
+	notifyMu           sync.RWMutex
+	writeHooks         []WriteHook
+	subscribers        map[int]func(WriteEvent)
+	nextSubscriber     int
 }
 
 // Request contains the connection and Modbus frame.
 type Request struct {
-	conn  io.ReadWriteCloser
-	frame Framer
+	conn     io.ReadWriteCloser
+	frame    Framer
+	received time.Time
+	fault    *Fault
 }
 
 // NewServer creates a new Modbus server (slave).
 func NewServer() *Server {
+	s := newServer()
+
+	s.goroutines.Add(1)
+	go s.handler()
+
+	return s
+}
+
+// newServer creates a server without starting its handler, as used for
+// units.
+func newServer() *Server {
 	s := &Server{}
 
 	// Allocate Modbus memory maps.
-	s.DiscreteInputs = make([]byte, 65536)
-	s.Coils = make([]byte, 65536)
-	s.HoldingRegisters = make([]uint16, 65536)
-	s.InputRegisters = make([]uint16, 65536)
+	s.memory = newMemory()
+
+	s.diag = newDiagnostics()
+	s.bus = s.diag
 
 	// Add default functions.
 	s.function[1] = ReadCoils
@@ -45,11 +134,22 @@ func NewServer() *Server {
 	s.function[4] = ReadInputRegisters
 	s.function[5] = WriteSingleCoil
 	s.function[6] = WriteHoldingRegister
+	s.function[7] = ReadExceptionStatus
+	s.function[8] = Diagnostic
+	s.function[11] = GetCommEventCounter
+	s.function[12] = GetCommEventLog
 	s.function[15] = WriteMultipleCoils
 	s.function[16] = WriteHoldingRegisters
+	s.function[20] = ReadFileRecord
+	s.function[21] = WriteFileRecord
+	s.function[22] = MaskWriteRegister
+	s.function[23] = ReadWriteMultipleRegisters
+	s.function[24] = ReadFIFOQueue
+	s.function[43] = ReadDeviceIdentification
 
 	s.requestChan = make(chan *Request)
-	go s.handler()
+	s.done = make(chan struct{})
+	s.failed = make(chan error, 1)
 
 	return s
 }
@@ -59,42 +159,183 @@ func (s *Server) RegisterFunctionHandler(funcCode uint8, function func(*Server,
 	s.function[funcCode] = function
 }
 
+// AddUnit adds a unit with its own memory maps and function table, answering
+// requests for the given unit identifier. Any unit previously added with the
+// same identifier is replaced. The returned unit is configured like any other
+// server, for example with RegisterFunctionHandler. The unit keeps its own
+// slave diagnostic counters but shares the bus counters of the server.
+func (s *Server) AddUnit(unitID uint8) *Server {
+	unit := newServer()
+	unit.bus = s.bus
+	unit.parent = s
+
+	s.unitsMu.Lock()
+	defer s.unitsMu.Unlock()
+	if s.units == nil {
+		s.units = make(map[uint8]*Server)
+	}
+	s.units[unitID] = unit
+	return unit
+}
+
+// Unit returns the unit added for the given unit identifier, or nil.
+func (s *Server) Unit(unitID uint8) *Server {
+	s.unitsMu.RLock()
+	defer s.unitsMu.RUnlock()
+	return s.units[unitID]
+}
+
+// RemoveUnit removes the unit added for the given unit identifier.
+func (s *Server) RemoveUnit(unitID uint8) {
+	s.unitsMu.Lock()
+	defer s.unitsMu.Unlock()
+	delete(s.units, unitID)
+}
+
+// lookupUnit returns the server that should answer a request for unitID,
+// or nil when the request is for an unknown unit that must be rejected.
+// Serial requests are only answered by the server for its SlaveAddress,
+// when set, and a gateway never answers unknown units from its own memory.
+func (s *Server) lookupUnit(unitID uint8, serial, gateway bool) *Server {
+	if unit := s.Unit(unitID); unit != nil {
+		return unit
+	}
+	if serial && s.SlaveAddress != 0 {
+		if unitID == s.SlaveAddress {
+			return s
+		}
+		return nil
+	}
+	if s.UnknownUnits == ServeUnknownUnits && !gateway {
+		return s
+	}
+	return nil
+}
+
+// handle returns the response to a request, or nil if no response should be
+// sent.
 func (s *Server) handle(request *Request) Framer {
+	s.bus.countBusMessage()
+
+	if !s.authorized(request) {
+		response := request.frame.Copy()
+		response.SetException(&IllegalFunction)
+		return response
+	}
+
+	unitID := request.frame.GetUnitID()
+	_, tcp := request.frame.(*TCPFrame)
+	if !tcp && unitID == 0 {
+		s.broadcast(request)
+		return nil
+	}
+
+	downstream, gateway := s.gatewayRoute(unitID)
+	if downstream != nil {
+		return s.forward(request, downstream)
+	}
+
+	unit := s.lookupUnit(unitID, !tcp, gateway)
+	if unit == nil {
+		if tcp {
+			response := request.frame.Copy()
+			if gateway {
+				response.SetException(&GatewayPathUnavailable)
+			} else {
+				response.SetException(&GatewayTargetDeviceFailedtoRespond)
+			}
+			return response
+		}
+		return nil
+	}
+	return unit.execute(request)
+}
+
+// broadcast runs a serial broadcast request (address 0) on the server and on
+// each of its units, in unit identifier order. No response is sent, so every
+// server counts the request as unanswered.
+func (s *Server) broadcast(request *Request) {
+	servers := []*Server{s}
+	s.unitsMu.RLock()
+	ids := make([]int, 0, len(s.units))
+	for id := range s.units {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		servers = append(servers, s.units[uint8(id)])
+	}
+	s.unitsMu.RUnlock()
+
+	for _, server := range servers {
+		if server.diag.receive(request.frame) {
+			server.callFunction(request)
+			server.diag.countNoResponse()
+		}
+	}
+}
+
+// execute runs the requested function against the server's memory, unless a
+// fault picked for the request answers it with an exception. It returns nil
+// if the server is in listen only mode.
+func (s *Server) execute(request *Request) Framer {
 	var exception *Exception
 	var data []byte
 
-	response := request.frame.Copy()
+	frame := request.frame
 
-	function := request.frame.GetFunction()
-	if s.function[function] != nil {
-		data, exception = s.function[function](s, request.frame)
-		response.SetData(data)
-	} else {
-		exception = &IllegalFunction
+	if !s.diag.receive(frame) {
+		return nil
 	}
 
-	if exception != &Success {
+	response := frame.Copy()
+
+	function := frame.GetFunction()
+	request.fault = s.pickFault(frame)
+	if exception = request.fault.exception(); exception != nil {
+		data = []byte{}
+	} else {
+		data, exception = s.callFunction(request)
+	}
+	if exception == nil {
+		exception = &Success
+	}
+	if *exception != Success {
 		response.SetException(exception)
+	} else {
+		response.SetData(data)
 	}
 
+	if !s.diag.send(function, exception) {
+		return nil
+	}
 	return response
 }
 
+// callFunction runs the handler of the requested function through the
+// middleware. A handler that panics, for example a custom handler given a
+// malformed request, answers SlaveDeviceFailure instead of stopping the
+// server.
+func (s *Server) callFunction(request *Request) (data []byte, exception *Exception) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("function %v handler panic: %v\n", request.frame.GetFunction(), r)
+			data, exception = []byte{}, &SlaveDeviceFailure
+		}
+	}()
+	return s.functionHandler(request.frame.GetFunction())(s.requestContext(request))
+}
+
 // All requests are handled synchronously to prevent modbus memory corruption.
 func (s *Server) handler() {
+	defer s.goroutines.Done()
 	for {
-		request := <-s.requestChan
-		response := s.handle(request)
-		request.conn.Write(response.Bytes())
-	}
-}
-
-// Close stops listening to TCP/IP ports and closes serial ports.
-func (s *Server) Close() {
-	for _, listen := range s.listeners {
-		listen.Close()
-	}
-	for _, port := range s.ports {
-		port.Close()
+		select {
+		case request := <-s.requestChan:
+			s.respond(request)
+			s.inFlight.Done()
+		case <-s.done:
+			return
+		}
 	}
 }
@@ -1,6 +1,8 @@
 package mbserver
 
 import (
+	"io"
+	"net"
 	"testing"
 	"time"
 
@@ -43,6 +45,76 @@ func TestUnsupportedFunction(t *testing.T) {
 	}
 }
 
+func TestUnits(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{100})
+	s.AddUnit(1).WriteHolding(0, []uint16{1})
+	s.AddUnit(2).WriteHolding(0, []uint16{2})
+
+	var frame TCPFrame
+	frame.Function = 3
+	SetDataWithRegisterAndNumber(&frame, 0, 1)
+
+	var req Request
+	req.frame = &frame
+
+	for _, unitID := range []uint8{1, 2, 3} {
+		frame.Device = unitID
+		response := s.handle(&req)
+		exception := GetException(response)
+		if exception != Success {
+			t.Fatalf("unit %d: expected Success, got %v", unitID, exception.String())
+		}
+		expect := []byte{2, 0, unitID}
+		if unitID == 3 {
+			// Unknown units are served from the server's own memory.
+			expect = []byte{2, 0, 100}
+		}
+		got := response.GetData()
+		if !isEqual(expect, got) {
+			t.Errorf("unit %d: expected %v, got %v", unitID, expect, got)
+		}
+	}
+
+	s.RemoveUnit(2)
+	if s.Unit(2) != nil {
+		t.Errorf("expected unit 2 to be removed")
+	}
+}
+
+func TestUnknownUnitRejected(t *testing.T) {
+	s := NewServer()
+	s.UnknownUnits = RejectUnknownUnits
+	s.AddUnit(1)
+
+	var tcpFrame TCPFrame
+	tcpFrame.Device = 2
+	tcpFrame.Function = 3
+	SetDataWithRegisterAndNumber(&tcpFrame, 0, 1)
+
+	var req Request
+	req.frame = &tcpFrame
+	response := s.handle(&req)
+	exception := GetException(response)
+	if exception != GatewayTargetDeviceFailedtoRespond {
+		t.Errorf("expected GatewayTargetDeviceFailedtoRespond, got %v", exception.String())
+	}
+
+	rtuFrame := &RTUFrame{Address: 2, Function: 3}
+	SetDataWithRegisterAndNumber(rtuFrame, 0, 1)
+	req.frame = rtuFrame
+	if response := s.handle(&req); response != nil {
+		t.Errorf("expected no response, got %v", response.Bytes())
+	}
+
+	rtuFrame.Address = 1
+	response = s.handle(&req)
+	exception = GetException(response)
+	if exception != Success {
+		t.Errorf("expected Success, got %v", exception.String())
+	}
+}
+
 func TestModbus(t *testing.T) {
 	// Server
 	s := NewServer()
@@ -123,8 +195,8 @@ func TestModbus(t *testing.T) {
 	}
 
 	// Input registers
-	s.InputRegisters[65530] = 1
-	s.InputRegisters[65535] = 65535
+	s.WriteInput(65530, []uint16{1})
+	s.WriteInput(65535, []uint16{65535})
 	results, err = client.ReadInputRegisters(65530, 6)
 	if err != nil {
 		t.Errorf("expected nil, got %v\n", err)
@@ -136,3 +208,230 @@ func TestModbus(t *testing.T) {
 		t.Errorf("expected %v, got %v", expect, got)
 	}
 }
+
+func TestModbusTCPPipelined(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{7})
+	addr := getFreePort()
+	err := s.ListenTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := func(transaction uint16) []byte {
+		frame := &TCPFrame{TransactionIdentifier: transaction, Device: 1, Function: 3}
+		SetDataWithRegisterAndNumber(frame, 0, 1)
+		return frame.Bytes()
+	}
+
+	// Two complete requests and the first half of a third in one write.
+	var packet []byte
+	packet = append(packet, request(1)...)
+	packet = append(packet, request(2)...)
+	third := request(3)
+	packet = append(packet, third[:5]...)
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Write(third[5:]); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+
+	for transaction := uint16(1); transaction <= 3; transaction++ {
+		response := make([]byte, 11)
+		if _, err := io.ReadFull(conn, response); err != nil {
+			t.Fatalf("failed to read response %d, got %v\n", transaction, err)
+		}
+		expect := []byte{0, byte(transaction), 0, 0, 0, 5, 1, 3, 2, 0, 7}
+		if !isEqual(expect, response) {
+			t.Errorf("expected %v, got %v", expect, response)
+		}
+	}
+}
+
+func TestModbusRTUTCPFragmented(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{7})
+	addr := getFreePort()
+	err := s.ListenRTUTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(request, 0, 1)
+	packet := request.Bytes()
+
+	// A frame with a bad CRC, then a good frame split over two writes.
+	bad := append([]byte{}, packet...)
+	bad[len(bad)-1]++
+	if _, err := conn.Write(append(bad, packet[:3]...)); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Write(packet[3:]); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+
+	response := make([]byte, 7)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("failed to read, got %v\n", err)
+	}
+	frame, err := NewRTUFrame(response)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []byte{2, 0, 7}
+	got := frame.Data
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestModbusRTUTCPPipelinedUnknownLength(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{7})
+	s.RegisterFunctionHandler(65, func(s *Server, frame Framer) ([]byte, *Exception) {
+		return frame.GetData(), &Success
+	})
+	addr := getFreePort()
+	err := s.ListenRTUTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A custom function code, whose length is only known from its CRC,
+	// followed by a request in the same write.
+	custom := &RTUFrame{Address: 1, Function: 65, Data: []byte{1, 2, 3}}
+	request := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(request, 0, 1)
+	if _, err := conn.Write(append(custom.Bytes(), request.Bytes()...)); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+
+	response := make([]byte, len(custom.Bytes()))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("failed to read, got %v\n", err)
+	}
+	if !isEqual(custom.Bytes(), response) {
+		t.Errorf("expected %v, got %v", custom.Bytes(), response)
+	}
+	response = make([]byte, 7)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("failed to read, got %v\n", err)
+	}
+	frame, err := NewRTUFrame(response)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []byte{2, 0, 7}
+	if !isEqual(expect, frame.Data) {
+		t.Errorf("expected %v, got %v", expect, frame.Data)
+	}
+}
+
+func TestModbusRTUTCPFragmentedUnknownLength(t *testing.T) {
+	s := NewServer()
+	s.RegisterFunctionHandler(65, func(s *Server, frame Framer) ([]byte, *Exception) {
+		return frame.GetData(), &Success
+	})
+	addr := getFreePort()
+	err := s.ListenRTUTCP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A custom function code split over two writes waits for its CRC.
+	packet := (&RTUFrame{Address: 1, Function: 65, Data: []byte{1, 2, 3}}).Bytes()
+	if _, err := conn.Write(packet[:3]); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := conn.Write(packet[3:]); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+
+	response := make([]byte, len(packet))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("failed to read, got %v\n", err)
+	}
+	if !isEqual(packet, response) {
+		t.Errorf("expected %v, got %v", packet, response)
+	}
+}
+
+func TestModbusUDP(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{7})
+	addr := getFreePort()
+	err := s.ListenUDP(addr)
+	if err != nil {
+		t.Fatalf("failed to listen, got %v\n", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect, got %v\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A bad datagram is counted and ignored.
+	if _, err := conn.Write([]byte{0, 1, 0, 0, 0, 9, 1, 3}); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+
+	frame := &TCPFrame{TransactionIdentifier: 1, Device: 1, Function: 3}
+	SetDataWithRegisterAndNumber(frame, 0, 1)
+	if _, err := conn.Write(frame.Bytes()); err != nil {
+		t.Fatalf("failed to write, got %v\n", err)
+	}
+	response := make([]byte, tcpMaxADULength)
+	n, err := conn.Read(response)
+	if err != nil {
+		t.Fatalf("failed to read response, got %v\n", err)
+	}
+	expect := []byte{0, 1, 0, 0, 0, 5, 1, 3, 2, 0, 7}
+	if !isEqual(expect, response[:n]) {
+		t.Errorf("expected %v, got %v", expect, response[:n])
+	}
+
+	diag := s.Diagnostics()
+	if diag.BusMessageCount != 1 || diag.BusCommunicationErrorCount != 1 {
+		t.Errorf("expected 1 message and 1 error, got %+v", diag)
+	}
+}
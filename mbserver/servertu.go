@@ -2,7 +2,7 @@ package mbserver
 
 import (
 	"io"
-	"log"
+	"time"
 
 	"github.com/goburrow/serial"
 )
@@ -12,39 +12,106 @@ import (
 func (s *Server) ListenRTU(serialConfig *serial.Config) (err error) {
 	port, err := serial.Open(serialConfig)
 	if err != nil {
-		log.Fatalf("failed to open %s: %v\n", serialConfig.Address, err)
+		s.logf("failed to open %s: %v\n", serialConfig.Address, err)
+		return err
 	}
-	s.ports = append(s.ports, port)
-	go s.acceptSerialRequests(port)
-	return err
+	return s.listen(port, func() error {
+		s.acceptSerialRequests(port, rtuFrameSilence(serialConfig.BaudRate))
+		return nil
+	})
 }
 
-func (s *Server) acceptSerialRequests(port serial.Port) {
+// rtuFrameSilence returns the 3.5 character silence that separates RTU frames
+// at the given baud rate. Above 19200 baud the specification fixes it at
+// 1.75ms.
+func rtuFrameSilence(baudRate int) time.Duration {
+	if baudRate <= 0 || baudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	// A character is 11 bits: start bit, 8 data bits, parity and stop bit.
+	return time.Duration(35*11) * time.Second / time.Duration(10*baudRate)
+}
+
+// acceptSerialRequests splits the bytes received on a serial port into RTU
+// frames. A frame ends when its length, known from the function code, has
+// been received, or when the line has been silent for the given duration.
+func (s *Server) acceptSerialRequests(port serial.Port, silence time.Duration) {
+	chunks := make(chan []byte)
+	go s.readSerial(port, chunks)
+
+	var buffer []byte
+	timer := time.NewTimer(silence)
+	timer.Stop()
+
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			buffer = s.handleRTUStream(port, append(buffer, chunk...), false)
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(silence)
+		case <-timer.C:
+			buffer = s.handleRTUStream(port, buffer, true)
+		}
+	}
+}
+
+// readSerial sends the bytes read from a serial port to chunks until the port
+// is closed. Read timeouts only mean that the line is idle.
+func (s *Server) readSerial(port serial.Port, chunks chan<- []byte) {
+	defer close(chunks)
+
 	for {
 		buffer := make([]byte, 512)
 
 		bytesRead, err := port.Read(buffer)
 		if err != nil {
+			if err == serial.ErrTimeout {
+				continue
+			}
 			if err != io.EOF {
-				log.Printf("serial read error %v\n", err)
+				s.logf("serial read error %v\n", err)
 			}
 			return
 		}
 
 		if bytesRead != 0 {
+			chunks <- buffer[:bytesRead]
+		}
+	}
+}
 
-			// Set the length of the packet to the number of read bytes.
-			packet := buffer[:bytesRead]
-
-			frame, err := NewRTUFrame(packet)
-			if err != nil {
-				log.Printf("bad serial frame error %v\n", err)
-				return
-			}
+// handleRTUStream passes every RTU frame at the start of buffer to the
+// handler and returns the bytes that do not yet make up a frame. Bad frames
+// are logged and skipped. Once the server is shutting down the remaining
+// bytes are dropped.
+func (s *Server) handleRTUStream(conn io.ReadWriteCloser, buffer []byte, endOfFrame bool) []byte {
+	for len(buffer) > 0 {
+		frame, consumed, err := nextRTUFrame(buffer, endOfFrame)
+		if consumed == 0 {
+			break
+		}
+		buffer = buffer[consumed:]
+		if err != nil {
+			s.logf("bad serial frame error %v\n", err)
+			s.bus.countCommunicationError()
+			continue
+		}
 
-			request := &Request{port, frame}
+		request := &Request{conn: conn, frame: frame}
 
-			s.requestChan <- request
+		if !s.submit(request) {
+			return nil
 		}
 	}
+	return buffer
 }
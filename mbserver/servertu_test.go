@@ -0,0 +1,182 @@
+package mbserver
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// fakePort is a serial.Port that receives the chunks sent on reads and
+// records what is written to it.
+type fakePort struct {
+	reads  chan []byte
+	writes chan []byte
+}
+
+func newFakePort() *fakePort {
+	return &fakePort{
+		reads:  make(chan []byte),
+		writes: make(chan []byte, 16),
+	}
+}
+
+func (p *fakePort) Open(*serial.Config) error { return nil }
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	chunk, ok := <-p.reads
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, chunk), nil
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.writes <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (p *fakePort) Close() error {
+	close(p.reads)
+	return nil
+}
+
+// response waits for the next write to the port.
+func (p *fakePort) response(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case b := <-p.writes:
+		return b
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for a response")
+	}
+	return nil
+}
+
+// noResponse checks that nothing is written to the port for a while.
+func (p *fakePort) noResponse(t *testing.T) {
+	t.Helper()
+	select {
+	case b := <-p.writes:
+		t.Errorf("expected no response, got %v", b)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRTUFrameSilence(t *testing.T) {
+	got := rtuFrameSilence(9600)
+	expect := 4010416 * time.Nanosecond
+	if got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	got = rtuFrameSilence(115200)
+	expect = 1750 * time.Microsecond
+	if got != expect {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+}
+
+func TestSerialRequestsFragmented(t *testing.T) {
+	s := NewServer()
+	s.WriteHolding(0, []uint16{7})
+	port := newFakePort()
+	defer port.Close()
+	go s.acceptSerialRequests(port, rtuFrameSilence(9600))
+
+	request := &RTUFrame{Address: 1, Function: 3}
+	SetDataWithRegisterAndNumber(request, 0, 1)
+	packet := request.Bytes()
+
+	// Noise followed by silence is dropped, and a frame arriving in
+	// fragments is still answered.
+	port.reads <- []byte{0x55, 0xaa}
+	time.Sleep(10 * time.Millisecond)
+	port.reads <- packet[:2]
+	port.reads <- packet[2:5]
+	port.reads <- packet[5:]
+
+	frame, err := NewRTUFrame(port.response(t))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	expect := []byte{2, 0, 7}
+	got := frame.Data
+	if !isEqual(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	// A bad CRC does not stop the listener.
+	bad := append([]byte{}, packet...)
+	bad[len(bad)-1]++
+	port.reads <- bad
+	port.noResponse(t)
+	port.reads <- packet
+	port.response(t)
+}
+
+func TestSerialAddressFiltering(t *testing.T) {
+	s := NewServer()
+	s.SlaveAddress = 5
+	unit := s.AddUnit(7)
+	port := newFakePort()
+	defer port.Close()
+	go s.acceptSerialRequests(port, rtuFrameSilence(9600))
+
+	read := func(address uint8) *RTUFrame {
+		request := &RTUFrame{Address: address, Function: 3}
+		SetDataWithRegisterAndNumber(request, 0, 1)
+		return request
+	}
+
+	// Frames for other slaves on the bus are ignored.
+	port.reads <- read(1).Bytes()
+	port.noResponse(t)
+	for _, address := range []uint8{5, 7} {
+		port.reads <- read(address).Bytes()
+		frame, err := NewRTUFrame(port.response(t))
+		if err != nil || frame.Address != address {
+			t.Errorf("expected a response from %v, got %v %v", address, frame, err)
+		}
+	}
+
+	// A broadcast write is applied by every slave and answered by none.
+	write := &RTUFrame{Address: 0, Function: 6}
+	SetDataWithRegisterAndNumber(write, 0, 9)
+	port.reads <- write.Bytes()
+	port.noResponse(t)
+	port.reads <- read(5).Bytes()
+	port.response(t)
+
+	if got, _ := s.ReadHolding(0, 1); !isEqual([]uint16{9}, got) {
+		t.Errorf("expected %v, got %v", []uint16{9}, got)
+	}
+	if got, _ := unit.ReadHolding(0, 1); !isEqual([]uint16{9}, got) {
+		t.Errorf("expected %v, got %v", []uint16{9}, got)
+	}
+	if got := unit.Diagnostics().SlaveNoResponseCount; got != 1 {
+		t.Errorf("expected %v, got %v", 1, got)
+	}
+}
+
+func TestSerialReturnQueryData(t *testing.T) {
+	s := NewServer()
+	port := newFakePort()
+	defer port.Close()
+	go s.acceptSerialRequests(port, rtuFrameSilence(9600))
+
+	// Return Query Data with other than two bytes of data ends at the
+	// silence after it.
+	for _, data := range [][]byte{{0, 0, 0xA5, 0x37, 0x42, 0x11}, {0, 0, 0xA5}} {
+		request := &RTUFrame{Address: 1, Function: 8, Data: data}
+		port.reads <- request.Bytes()
+		frame, err := NewRTUFrame(port.response(t))
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if !isEqual(data, frame.Data) {
+			t.Errorf("expected %v, got %v", data, frame.Data)
+		}
+	}
+}
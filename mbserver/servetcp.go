@@ -1,10 +1,9 @@
 package mbserver
 
 import (
+	"bufio"
 	"io"
-	"log"
 	"net"
-	"strings"
 )
 
 // accept will accept TCP connections.
@@ -12,39 +11,37 @@ func (s *Server) accept(listen net.Listener) error {
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if isClosedError(err) {
 				return nil
 			}
-			log.Printf("Unable to accept connections: %#v\n", err)
+			s.logf("Unable to accept connections: %#v\n", err)
 			return err
 		}
 
-		go func(conn net.Conn) {
-			defer conn.Close()
-
-			for {
-				packet := make([]byte, 512)
-				bytesRead, err := conn.Read(packet)
-				if err != nil {
-					if err != io.EOF {
-						log.Printf("read error %v\n", err)
-					}
-					return
-				}
-				// Set the length of the packet to the number of read bytes.
-				packet = packet[:bytesRead]
+		s.serveConn(conn, s.serveTCPConn)
+	}
+}
 
-				frame, err := NewTCPFrame(packet)
-				if err != nil {
-					log.Printf("bad packet error %v\n", err)
-					return
-				}
+// serveTCPConn passes the Modbus TCP requests read from a connection to the
+// handler until the connection is closed.
+func (s *Server) serveTCPConn(conn net.Conn) {
+	// Requests are read one ADU at a time and handed to the handler in
+	// order, so pipelined requests are answered in the order they were sent.
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := readTCPFrame(reader)
+		if err != nil {
+			if err != io.EOF && !isClosedError(err) {
+				s.logf("read error %v\n", err)
+			}
+			return
+		}
 
-				request := &Request{conn, frame}
+		request := &Request{conn: conn, frame: frame}
 
-				s.requestChan <- request
-			}
-		}(conn)
+		if !s.submit(request) {
+			return
+		}
 	}
 }
 
@@ -52,12 +49,10 @@ func (s *Server) accept(listen net.Listener) error {
 func (s *Server) ListenTCP(addressPort string) (err error) {
 	listen, err := net.Listen("tcp", addressPort)
 	if err != nil {
-		log.Printf("Failed to Listen: %v\n", err)
+		s.logf("Failed to Listen: %v\n", err)
 		return err
 	}
-	s.listeners = append(s.listeners, listen)
-	go s.accept(listen)
-	return err
+	return s.listen(listen, func() error { return s.accept(listen) })
 }
 
 // -------------------------------------
@@ -67,51 +62,68 @@ func (s *Server) ListenTCP(addressPort string) (err error) {
 func (s *Server) ListenRTUTCP(addressPort string) (err error) {
 	listen, err := net.Listen("tcp", addressPort)
 	if err != nil {
-		log.Printf("Failed to Listen: %v\n", err)
+		s.logf("Failed to Listen: %v\n", err)
 		return err
 	}
-	s.listeners = append(s.listeners, listen)
-	go s.acceptRTUTCP(listen)
-	return err
+	return s.listen(listen, func() error { return s.acceptRTUTCP(listen) })
 }
 
-// accept will accept TCP connections.
+// acceptRTUTCP will accept TCP connections carrying RTU frames.
 func (s *Server) acceptRTUTCP(listen net.Listener) error {
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if isClosedError(err) {
 				return nil
 			}
-			log.Printf("Unable to accept connections: %#v\n", err)
+			s.logf("Unable to accept connections: %#v\n", err)
 			return err
 		}
 
-		go func(conn net.Conn) {
-			defer conn.Close()
-
+		s.serveConn(conn, func(conn net.Conn) {
+			// There is no inter-frame silence on a TCP stream, so frames
+			// are split by the length implied by their function code.
+			var buffer []byte
 			for {
 				packet := make([]byte, 512)
 				bytesRead, err := conn.Read(packet)
 				if err != nil {
-					if err != io.EOF {
-						log.Printf("read error %v\n", err)
+					if err != io.EOF && !isClosedError(err) {
+						s.logf("read error %v\n", err)
 					}
 					return
 				}
-				// Set the length of the packet to the number of read bytes.
-				packet = packet[:bytesRead]
 
-				frame, err := NewRTUFrame(packet)
-				if err != nil {
-					log.Printf("bad packet error %v\n", err)
-					return
-				}
+				buffer = s.handleRTUStream(conn, append(buffer, packet[:bytesRead]...), false)
+
+				// A function code of unknown length ends at the first
+				// valid CRC, leaving any frames pipelined after it in the
+				// buffer. Without a valid CRC the rest of the frame may
+				// still be on its way, so bytes are only skipped to resync
+				// on a complete frame following them, or once the buffer
+				// could hold a whole ADU.
+				for rtuRequestLength(buffer) < 0 {
+					frame, length := matchRTUFrame(buffer)
+					if frame == nil {
+						skip := resyncRTUFrame(buffer)
+						if skip == 0 {
+							if len(buffer) < rtuMaxADULength {
+								break
+							}
+							skip = 1
+						}
+						buffer = s.handleRTUStream(conn, buffer[skip:], false)
+						continue
+					}
 
-				request := &Request{conn, frame}
+					request := &Request{conn: conn, frame: frame}
 
-				s.requestChan <- request
+					if !s.submit(request) {
+						return
+					}
+					buffer = s.handleRTUStream(conn, buffer[length:], false)
+				}
 			}
-		}(conn)
+		})
 	}
 }
@@ -0,0 +1,170 @@
+package mbserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RoleOID identifies the X.509 v3 extension holding the role of a
+// Modbus/TCP Security client certificate, encoded as an ASN.1 UTF8String.
+var RoleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 1}
+
+// tlsHandshakeTimeout limits how long a client has to complete the TLS
+// handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// errTLSConfig is returned by ListenTLS for a config without a server
+// certificate or without the CAs that sign client certificates.
+var errTLSConfig = errors.New("mbserver: TLS config needs a server certificate and client CAs")
+
+// CertificateRole returns the role held by a client certificate, or "" if it
+// has no role extension. A certificate with more than one role, or with a
+// role that is not a UTF8String, returns an error.
+func CertificateRole(cert *x509.Certificate) (string, error) {
+	var role string
+	found := false
+	for _, extension := range cert.Extensions {
+		if !extension.Id.Equal(RoleOID) {
+			continue
+		}
+		if found {
+			return "", fmt.Errorf("certificate has more than one role")
+		}
+		found = true
+		rest, err := asn1.UnmarshalWithParams(extension.Value, &role, "utf8")
+		if err != nil {
+			return "", fmt.Errorf("bad role extension: %v", err)
+		}
+		if len(rest) != 0 {
+			return "", fmt.Errorf("bad role extension: trailing data")
+		}
+	}
+	return role, nil
+}
+
+// Authorization describes a request from a Modbus/TCP Security client, for
+// the authorization hook to allow or deny.
+type Authorization struct {
+	Role     string
+	Unit     uint8
+	Function uint8
+	// Addresses are the address ranges the request accesses, for requests
+	// of the functions that read and write the memory maps.
+	Addresses   []AddressRange
+	Client      net.Addr
+	Certificate *x509.Certificate
+}
+
+// AuthorizationHook allows a request from a Modbus/TCP Security client by
+// returning true. Denied requests are answered with IllegalFunction, as the
+// Modbus/TCP Security specification requires.
+type AuthorizationHook func(request Authorization) bool
+
+// SetAuthorizationHook sets the hook that authorizes the requests received
+// by ListenTLS. Without a hook every request from a client with a valid
+// certificate is allowed.
+func (s *Server) SetAuthorizationHook(hook AuthorizationHook) {
+	s.authorizeMu.Lock()
+	defer s.authorizeMu.Unlock()
+	s.authorize = hook
+}
+
+// secureConn is a Modbus/TCP Security connection with the role of its
+// client.
+type secureConn struct {
+	net.Conn
+	role        string
+	certificate *x509.Certificate
+}
+
+// ListenTLS starts the Modbus/TCP Security server listening on
+// "address:port", port 802 by default. The config must hold the server
+// certificate and the CAs that sign client certificates. The specification
+// requires TLS 1.2 or later and verified client certificates, so lower
+// versions and connections without a certificate signed by the config's
+// ClientCAs are refused whatever the config says. A nil config, or one
+// without Certificates or GetCertificate, or without ClientCAs, returns an
+// error.
+func (s *Server) ListenTLS(addressPort string, config *tls.Config) (err error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) || config.ClientCAs == nil {
+		s.logf("Failed to Listen: %v\n", errTLSConfig)
+		return errTLSConfig
+	}
+	config = config.Clone()
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	listen, err := tls.Listen("tcp", addressPort, config)
+	if err != nil {
+		s.logf("Failed to Listen: %v\n", err)
+		return err
+	}
+	return s.listen(listen, func() error { return s.acceptTLS(listen) })
+}
+
+// acceptTLS will accept Modbus/TCP Security connections.
+func (s *Server) acceptTLS(listen net.Listener) error {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			if isClosedError(err) {
+				return nil
+			}
+			s.logf("Unable to accept connections: %#v\n", err)
+			return err
+		}
+
+		s.serveConn(conn, func(conn net.Conn) {
+			tlsConn := conn.(*tls.Conn)
+			conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				s.logf("TLS handshake error %v\n", err)
+				return
+			}
+			conn.SetDeadline(time.Time{})
+
+			secure := &secureConn{Conn: conn}
+			if certificates := tlsConn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+				secure.certificate = certificates[0]
+				role, err := CertificateRole(secure.certificate)
+				if err != nil {
+					s.logf("client certificate error %v\n", err)
+					return
+				}
+				secure.role = role
+			}
+			s.serveTCPConn(secure)
+		})
+	}
+}
+
+// authorized reports whether the authorization hook allows a request.
+// Requests that did not arrive over Modbus/TCP Security are always allowed.
+func (s *Server) authorized(request *Request) bool {
+	conn, ok := request.conn.(*secureConn)
+	if !ok {
+		return true
+	}
+	s.authorizeMu.RLock()
+	hook := s.authorize
+	s.authorizeMu.RUnlock()
+	if hook == nil {
+		return true
+	}
+
+	return hook(Authorization{
+		Role:        conn.role,
+		Unit:        request.frame.GetUnitID(),
+		Function:    request.frame.GetFunction(),
+		Addresses:   requestAddressRanges(request.frame),
+		Client:      conn.RemoteAddr(),
+		Certificate: conn.certificate,
+	})
+}
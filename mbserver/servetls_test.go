@@ -0,0 +1,216 @@
+package mbserver
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA issues self-signed test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key}
+}
+
+// issue returns a server certificate for 127.0.0.1, or a client certificate
+// holding the given roles.
+func (ca *testCA) issue(t *testing.T, server bool, roles ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	for _, role := range roles {
+		value, err := asn1.MarshalWithParams(role, "utf8")
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: RoleOID, Value: value})
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificateRole(t *testing.T) {
+	operator, _ := asn1.MarshalWithParams("Operator", "utf8")
+	notUTF8, _ := asn1.Marshal(42)
+	tests := []struct {
+		extensions []pkix.Extension
+		expect     string
+		err        bool
+	}{
+		{nil, "", false},
+		{[]pkix.Extension{{Id: RoleOID, Value: operator}}, "Operator", false},
+		{[]pkix.Extension{{Id: RoleOID, Value: operator}, {Id: RoleOID, Value: operator}}, "", true},
+		{[]pkix.Extension{{Id: RoleOID, Value: notUTF8}}, "", true},
+	}
+	for _, test := range tests {
+		role, err := CertificateRole(&x509.Certificate{Extensions: test.extensions})
+		if (err != nil) != test.err {
+			t.Errorf("%v: expected error %v, got %v", test.extensions, test.err, err)
+		}
+		if role != test.expect {
+			t.Errorf("expected %v, got %v", test.expect, role)
+		}
+	}
+}
+
+func TestModbusTLS(t *testing.T) {
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	s := NewServer()
+	defer s.Close()
+	var authorizations []Authorization
+	s.SetAuthorizationHook(func(request Authorization) bool {
+		authorizations = append(authorizations, request)
+		// Operators can read anything but only write holding registers 0-9.
+		if request.Role != "Operator" {
+			return false
+		}
+		switch request.Function {
+		case 1, 2, 3, 4:
+			return true
+		case 6, 16:
+			r := request.Addresses[0]
+			return int(r.Start)+r.Quantity <= 10
+		}
+		return false
+	})
+
+	addr := getFreePort()
+	// Configs that cannot verify both ends are refused.
+	for _, config := range []*tls.Config{
+		nil,
+		{ClientCAs: pool},
+		{Certificates: []tls.Certificate{ca.issue(t, true)}},
+	} {
+		if err := s.ListenTLS(addr, config); err != errTLSConfig {
+			t.Errorf("expected %v, got %v", errTLSConfig, err)
+		}
+	}
+
+	// A config that would skip verifying client certificates is overridden.
+	err := s.ListenTLS(addr, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, true)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("failed to listen, got %v", err)
+	}
+
+	dial := func(cert ...tls.Certificate) (*tls.Conn, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, Certificates: cert})
+		if err == nil {
+			// TLS 1.3 reports a rejected client certificate on the first read.
+			conn.SetDeadline(time.Now().Add(time.Second))
+		}
+		return conn, err
+	}
+
+	conn, err := dial(ca.issue(t, false, "Operator"))
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		function uint8
+		address  uint16
+		expect   Exception
+	}{
+		{3, 100, Success},
+		{6, 9, Success},
+		{6, 10, IllegalFunction},
+		{5, 0, IllegalFunction},
+	}
+	for i, test := range tests {
+		frame := &TCPFrame{TransactionIdentifier: uint16(i), Device: 1, Function: test.function}
+		SetDataWithRegisterAndNumber(frame, test.address, 1)
+		frame.Length = uint16(len(frame.Data) + 2)
+		if _, err := conn.Write(frame.Bytes()); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		response, err := readTCPFrame(reader)
+		if err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if exception := GetException(response); exception != test.expect {
+			t.Errorf("function %v address %v: expected %v, got %v", test.function, test.address, test.expect, exception)
+		}
+	}
+	if len(authorizations) != len(tests) || authorizations[0].Role != "Operator" || authorizations[0].Client == nil {
+		t.Errorf("unexpected authorizations %+v", authorizations)
+	}
+
+	// Clients without a certificate, with more than one role or with a
+	// certificate not signed by ClientCAs are disconnected.
+	other := newTestCA(t)
+	refused := [][]tls.Certificate{
+		nil,
+		{ca.issue(t, false, "Operator", "Engineer")},
+		{other.issue(t, false, "Operator")},
+	}
+	for _, cert := range refused {
+		conn, err := dial(cert...)
+		if err != nil {
+			continue
+		}
+		frame := &TCPFrame{Length: 6, Device: 1, Function: 3, Data: []byte{0, 0, 0, 1}}
+		conn.Write(frame.Bytes())
+		if _, err := readTCPFrame(conn); err == nil {
+			t.Errorf("expected the connection to be refused")
+		}
+		conn.Close()
+	}
+}
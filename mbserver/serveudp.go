@@ -0,0 +1,76 @@
+package mbserver
+
+import (
+	"io"
+	"net"
+)
+
+// udpConn sends responses to the sender of a Modbus UDP request.
+type udpConn struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+// Read returns io.EOF, requests are read from the socket by acceptUDP.
+func (c *udpConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	return c.conn.WriteTo(b, c.addr)
+}
+
+// Close does nothing, the socket is shared by every sender.
+func (c *udpConn) Close() error {
+	return nil
+}
+
+// RemoteAddr returns the address of the sender.
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// LocalAddr returns the address of the socket.
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// ListenUDP starts the Modbus server listening for Modbus TCP frames sent in
+// UDP datagrams on "address:port". Each datagram holds one request, and the
+// response is sent to the address it came from.
+func (s *Server) ListenUDP(addressPort string) (err error) {
+	conn, err := net.ListenPacket("udp", addressPort)
+	if err != nil {
+		s.logf("Failed to Listen: %v\n", err)
+		return err
+	}
+	return s.listen(conn, func() error { return s.acceptUDP(conn) })
+}
+
+// acceptUDP will accept Modbus UDP datagrams.
+func (s *Server) acceptUDP(conn net.PacketConn) error {
+	for {
+		packet := make([]byte, tcpMaxADULength)
+		bytesRead, addr, err := conn.ReadFrom(packet)
+		if err != nil {
+			if isClosedError(err) {
+				return nil
+			}
+			s.logf("Unable to read datagrams: %#v\n", err)
+			return err
+		}
+
+		frame, err := NewTCPFrame(packet[:bytesRead])
+		if err != nil {
+			s.logf("bad UDP frame error %v\n", err)
+			s.bus.countCommunicationError()
+			continue
+		}
+
+		request := &Request{conn: &udpConn{conn, addr}, frame: frame}
+
+		if !s.submit(request) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package mbserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// A snapshot holds the memory image of a server and of its units. All
+// integers are big endian. Version 1 is laid out as:
+//
+//	magic          4 bytes "MBSS"
+//	version        uint16, 1
+//	image count    uint16
+//	images         one per server, the server itself first, then its units
+//	               by unit ID:
+//	  kind           uint8, 0 for the server, 1 for a unit
+//	  unit ID        uint8, 0 for the server
+//	  coils          8192 bytes, coil n in bit n%8 of byte n/8
+//	  discrete       8192 bytes, packed like the coils
+//	  holding        65536 uint16
+//	  input          65536 uint16
+//	  file count     uint32, then for each file by file number:
+//	    file number    uint16
+//	    record count   uint16, then the records as uint16
+//	  FIFO count     uint32, then for each FIFO queue by address:
+//	    address        uint16
+//	    value count    uint16, then the values as uint16
+//	checksum       uint32, CRC-32 (IEEE) of all the preceding bytes
+const (
+	snapshotMagic   = "MBSS"
+	snapshotVersion = 1
+)
+
+// errUnitAutoSave is returned by AutoSave on units.
+var errUnitAutoSave = errors.New("mbserver: units are saved with the server they were added to")
+
+// snapshotImage is the memory image of one server in a snapshot.
+type snapshotImage struct {
+	unit     bool
+	unitID   uint8
+	coils    []byte
+	discrete []byte
+	holding  []uint16
+	input    []uint16
+	files    map[uint16][]uint16
+	fifos    map[uint16][]uint16
+}
+
+// image copies the memory of a server.
+func (s *Server) image() *snapshotImage {
+	image := &snapshotImage{}
+
+	s.memoryMu.RLock()
+	image.coils = append([]byte{}, s.memory.coils...)
+	image.discrete = append([]byte{}, s.memory.discreteInputs...)
+	image.holding = append([]uint16{}, s.memory.holdingRegisters...)
+	image.input = append([]uint16{}, s.memory.inputRegisters...)
+	s.memoryMu.RUnlock()
+
+	s.filesMu.RLock()
+	image.files = copyTables(s.files)
+	image.fifos = copyTables(s.fifos)
+	s.filesMu.RUnlock()
+	return image
+}
+
+// restore replaces the memory of a server with an image.
+func (s *Server) restore(image *snapshotImage) {
+	s.memoryMu.Lock()
+	copy(s.memory.coils, image.coils)
+	copy(s.memory.discreteInputs, image.discrete)
+	copy(s.memory.holdingRegisters, image.holding)
+	copy(s.memory.inputRegisters, image.input)
+	s.memoryMu.Unlock()
+
+	s.filesMu.Lock()
+	s.files = image.files
+	s.fifos = image.fifos
+	s.filesMu.Unlock()
+}
+
+func copyTables(tables map[uint16][]uint16) map[uint16][]uint16 {
+	copied := make(map[uint16][]uint16, len(tables))
+	for key, values := range tables {
+		copied[key] = append([]uint16{}, values...)
+	}
+	return copied
+}
+
+// Snapshot writes the coils, discrete inputs, holding and input registers,
+// file records and FIFO queues of the server and of its units to w, in the
+// versioned format documented in snapshot.go. Each server's memory is copied
+// at once, so masters writing while the snapshot is taken see it taken
+// before or after their write.
+func (s *Server) Snapshot(w io.Writer) error {
+	images := []*snapshotImage{s.image()}
+
+	s.unitsMu.RLock()
+	ids := make([]int, 0, len(s.units))
+	for id := range s.units {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		image := s.units[uint8(id)].image()
+		image.unit = true
+		image.unitID = uint8(id)
+		images = append(images, image)
+	}
+	s.unitsMu.RUnlock()
+
+	buffered := bufio.NewWriter(w)
+	checksum := crc32.NewIEEE()
+	out := io.MultiWriter(buffered, checksum)
+
+	out.Write([]byte(snapshotMagic))
+	binary.Write(out, binary.BigEndian, uint16(snapshotVersion))
+	binary.Write(out, binary.BigEndian, uint16(len(images)))
+	for _, image := range images {
+		kind := uint8(0)
+		if image.unit {
+			kind = 1
+		}
+		out.Write([]byte{kind, image.unitID})
+		out.Write(bitsToBytes(bitValues(image.coils))[1:])
+		out.Write(bitsToBytes(bitValues(image.discrete))[1:])
+		binary.Write(out, binary.BigEndian, image.holding)
+		binary.Write(out, binary.BigEndian, image.input)
+		writeSnapshotTables(out, image.files)
+		writeSnapshotTables(out, image.fifos)
+	}
+	binary.Write(buffered, binary.BigEndian, checksum.Sum32())
+	return buffered.Flush()
+}
+
+// bitValues converts a table of bits stored one per byte.
+func bitValues(table []byte) []bool {
+	values := make([]bool, len(table))
+	for i, bit := range table {
+		values[i] = bit != 0
+	}
+	return values
+}
+
+// writeSnapshotTables writes files or FIFO queues ordered by key.
+func writeSnapshotTables(w io.Writer, tables map[uint16][]uint16) {
+	keys := make([]int, 0, len(tables))
+	for key := range tables {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	binary.Write(w, binary.BigEndian, uint32(len(keys)))
+	for _, key := range keys {
+		values := tables[uint16(key)]
+		binary.Write(w, binary.BigEndian, uint16(key))
+		binary.Write(w, binary.BigEndian, uint16(len(values)))
+		binary.Write(w, binary.BigEndian, values)
+	}
+}
+
+// Restore replaces the memory of the server and of its units with a snapshot
+// written by Snapshot. Units in the snapshot that have not been added are
+// added with AddUnit; units that are not in the snapshot are left as they
+// are. The snapshot is checked in full before anything is restored, so a
+// corrupt or truncated snapshot returns an error and changes nothing. Write
+// hooks and subscribers are not notified of restored values.
+func (s *Server) Restore(r io.Reader) error {
+	buffered := bufio.NewReader(r)
+	checksum := crc32.NewIEEE()
+	in := io.TeeReader(buffered, checksum)
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return fmt.Errorf("snapshot header: %v", err)
+	}
+	if string(header[:4]) != snapshotMagic {
+		return fmt.Errorf("not a snapshot")
+	}
+	if version := binary.BigEndian.Uint16(header[4:6]); version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	count := int(binary.BigEndian.Uint16(header[6:8]))
+	images := make([]*snapshotImage, 0, count)
+	for i := 0; i < count; i++ {
+		image, err := readSnapshotImage(in)
+		if err != nil {
+			return fmt.Errorf("snapshot image %d: %v", i, err)
+		}
+		if image.unit != (i > 0) {
+			return fmt.Errorf("snapshot image %d: unexpected kind", i)
+		}
+		images = append(images, image)
+	}
+
+	var sum uint32
+	if err := binary.Read(buffered, binary.BigEndian, &sum); err != nil {
+		return fmt.Errorf("snapshot checksum: %v", err)
+	}
+	if sum != checksum.Sum32() {
+		return fmt.Errorf("snapshot checksum mismatch")
+	}
+
+	for _, image := range images {
+		target := s
+		if image.unit {
+			if target = s.Unit(image.unitID); target == nil {
+				target = s.AddUnit(image.unitID)
+			}
+		}
+		target.restore(image)
+	}
+	return nil
+}
+
+// readSnapshotImage reads the memory image of one server.
+func readSnapshotImage(r io.Reader) (*snapshotImage, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] > 1 {
+		return nil, fmt.Errorf("unknown kind %d", header[0])
+	}
+	image := &snapshotImage{
+		unit:     header[0] == 1,
+		unitID:   header[1],
+		coils:    make([]byte, memorySize),
+		discrete: make([]byte, memorySize),
+		holding:  make([]uint16, memorySize),
+		input:    make([]uint16, memorySize),
+	}
+
+	packed := make([]byte, memorySize/8)
+	for _, table := range [][]byte{image.coils, image.discrete} {
+		if _, err := io.ReadFull(r, packed); err != nil {
+			return nil, err
+		}
+		for i := range table {
+			table[i] = bitAtPosition(packed[i/8], uint(i)%8)
+		}
+	}
+	for _, table := range [][]uint16{image.holding, image.input} {
+		if err := binary.Read(r, binary.BigEndian, table); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if image.files, err = readSnapshotTables(r); err != nil {
+		return nil, err
+	}
+	for file, records := range image.files {
+		if file == 0 || len(records) > maxFileRecords {
+			return nil, fmt.Errorf("bad file %d with %d records", file, len(records))
+		}
+	}
+	if image.fifos, err = readSnapshotTables(r); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// readSnapshotTables reads files or FIFO queues.
+func readSnapshotTables(r io.Reader) (map[uint16][]uint16, error) {
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if count > memorySize {
+		return nil, fmt.Errorf("bad table count %d", count)
+	}
+	tables := make(map[uint16][]uint16)
+	for i := uint32(0); i < count; i++ {
+		var header [2]uint16
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+		values := make([]uint16, header[1])
+		if err := binary.Read(r, binary.BigEndian, values); err != nil {
+			return nil, err
+		}
+		tables[header[0]] = values
+	}
+	return tables, nil
+}
+
+// AutoSave writes a snapshot of the server to the file at path every
+// interval, and once more when the server is shut down, after the last
+// request has been answered. A simulator restarted with Restore from that
+// file carries on where it stopped. The snapshot is written to path + ".tmp"
+// and renamed over path, so the file is never left half written. Failures are
+// logged.
+func (s *Server) AutoSave(path string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("autosave interval must be positive, got %v", interval)
+	}
+	if s.parent != nil {
+		return errUnitAutoSave
+	}
+
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if s.closing {
+		return ErrServerClosed
+	}
+	s.goroutines.Add(1)
+	go func() {
+		defer s.goroutines.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.saveSnapshot(path)
+			case <-s.done:
+				s.saveSnapshot(path)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// saveSnapshot writes a snapshot to a file, replacing it atomically.
+func (s *Server) saveSnapshot(path string) {
+	temp := path + ".tmp"
+	f, err := os.Create(temp)
+	if err == nil {
+		err = s.Snapshot(f)
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		s.logf("autosave to %s failed: %v\n", path, err)
+	}
+}
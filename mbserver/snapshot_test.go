@@ -0,0 +1,145 @@
+package mbserver
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.WriteCoils(65535, []bool{true})
+	s.WriteDiscrete(9, []bool{true, false, true})
+	s.WriteHolding(0, []uint16{1, 2, 3})
+	s.WriteInput(100, []uint16{0xFFFF})
+	s.SetFileRecords(4, 2, []uint16{7, 8})
+	s.SetFIFOQueue(30, []uint16{5, 6})
+	unit := s.AddUnit(7)
+	unit.WriteHolding(10, []uint16{42})
+
+	var snapshot bytes.Buffer
+	if err := s.Snapshot(&snapshot); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	restored := NewServer()
+	defer restored.Close()
+	restored.WriteHolding(3, []uint16{9})
+	other := restored.AddUnit(8)
+	other.WriteHolding(0, []uint16{1})
+	if err := restored.Restore(bytes.NewReader(snapshot.Bytes())); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	if got, _ := restored.ReadCoils(65534, 2); !isEqual([]bool{false, true}, got) {
+		t.Errorf("expected %v, got %v", []bool{false, true}, got)
+	}
+	if got, _ := restored.ReadDiscrete(9, 3); !isEqual([]bool{true, false, true}, got) {
+		t.Errorf("expected %v, got %v", []bool{true, false, true}, got)
+	}
+	if got, _ := restored.ReadHolding(0, 4); !isEqual([]uint16{1, 2, 3, 0}, got) {
+		t.Errorf("expected %v, got %v", []uint16{1, 2, 3, 0}, got)
+	}
+	if got, _ := restored.ReadInput(100, 1); !isEqual([]uint16{0xFFFF}, got) {
+		t.Errorf("expected %v, got %v", []uint16{0xFFFF}, got)
+	}
+	if got, _ := restored.FileRecords(4, 0, 4); !isEqual([]uint16{0, 0, 7, 8}, got) {
+		t.Errorf("expected %v, got %v", []uint16{0, 0, 7, 8}, got)
+	}
+	if got, _ := restored.FIFOQueue(30); !isEqual([]uint16{5, 6}, got) {
+		t.Errorf("expected %v, got %v", []uint16{5, 6}, got)
+	}
+
+	// Units in the snapshot are added, other units are left alone.
+	if restored.Unit(7) == nil {
+		t.Fatalf("expected unit 7 to be restored")
+	}
+	if got, _ := restored.Unit(7).ReadHolding(10, 1); !isEqual([]uint16{42}, got) {
+		t.Errorf("expected %v, got %v", []uint16{42}, got)
+	}
+	if got, _ := other.ReadHolding(0, 1); !isEqual([]uint16{1}, got) {
+		t.Errorf("expected %v, got %v", []uint16{1}, got)
+	}
+}
+
+func TestRestoreRejectsBadSnapshots(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.WriteHolding(0, []uint16{1})
+	var snapshot bytes.Buffer
+	s.Snapshot(&snapshot)
+	good := snapshot.Bytes()
+
+	corrupt := append([]byte{}, good...)
+	corrupt[100] ^= 1
+	version := append([]byte{}, good...)
+	version[5] = 2
+
+	tests := map[string][]byte{
+		"empty":     {},
+		"magic":     append([]byte("XXXX"), good[4:]...),
+		"version":   version,
+		"truncated": good[:len(good)-10],
+		"corrupt":   corrupt,
+	}
+	for name, data := range tests {
+		target := NewServer()
+		target.WriteHolding(0, []uint16{9})
+		if err := target.Restore(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if got, _ := target.ReadHolding(0, 1); !isEqual([]uint16{9}, got) {
+			t.Errorf("%s: expected %v, got %v", name, []uint16{9}, got)
+		}
+		target.Close()
+	}
+}
+
+func TestAutoSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device.snapshot")
+	s := NewServer()
+	if err := s.AddUnit(1).AutoSave(path, time.Second); err != errUnitAutoSave {
+		t.Errorf("expected %v, got %v", errUnitAutoSave, err)
+	}
+	if err := s.AutoSave(path, 10*time.Millisecond); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+
+	s.WriteHolding(0, []uint16{1})
+	time.Sleep(100 * time.Millisecond)
+	restored := NewServer()
+	defer restored.Close()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	err = restored.Restore(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if got, _ := restored.ReadHolding(0, 1); !isEqual([]uint16{1}, got) {
+		t.Errorf("expected %v, got %v", []uint16{1}, got)
+	}
+
+	// A last snapshot is written at shutdown.
+	s.WriteHolding(0, []uint16{2})
+	s.Shutdown(context.Background())
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	defer f.Close()
+	restored.Restore(f)
+	if got, _ := restored.ReadHolding(0, 1); !isEqual([]uint16{2}, got) {
+		t.Errorf("expected %v, got %v", []uint16{2}, got)
+	}
+
+	if err := s.AutoSave(path, time.Second); err != ErrServerClosed {
+		t.Errorf("expected %v, got %v", ErrServerClosed, err)
+	}
+}
@@ -0,0 +1,384 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// ByteOrder is the order in which the bytes of a value are stored in
+// registers. The letters name the bytes of the value from most to least
+// significant, in the order they are stored: ABCD is big endian, as in the
+// Modbus specification. The orders of 32-bit values extend to other sizes:
+// BADC swaps the bytes of each register, CDAB reverses the order of the
+// registers and DCBA does both.
+type ByteOrder int
+
+const (
+	// ABCD stores values big endian, most significant register first.
+	ABCD ByteOrder = iota
+	// DCBA stores values little endian, least significant register first
+	// with its bytes swapped.
+	DCBA
+	// BADC stores the most significant register first with its bytes
+	// swapped.
+	BADC
+	// CDAB stores the least significant register first, each register big
+	// endian.
+	CDAB
+)
+
+func (o ByteOrder) String() string {
+	switch o {
+	case ABCD:
+		return "ABCD"
+	case DCBA:
+		return "DCBA"
+	case BADC:
+		return "BADC"
+	case CDAB:
+		return "CDAB"
+	}
+	return "unknown"
+}
+
+// swapsBytes reports whether the order swaps the bytes of each register.
+func (o ByteOrder) swapsBytes() bool {
+	return o == DCBA || o == BADC
+}
+
+// swapsRegisters reports whether the order reverses the registers.
+func (o ByteOrder) swapsRegisters() bool {
+	return o == DCBA || o == CDAB
+}
+
+// orderRegisters stores the big endian bytes of a value, an even number of
+// them, in registers.
+func orderRegisters(bytes []byte, order ByteOrder) []uint16 {
+	registers := BytesToUint16(bytes)
+	if order.swapsBytes() {
+		for i, register := range registers {
+			registers[i] = register>>8 | register<<8
+		}
+	}
+	if order.swapsRegisters() {
+		for i, j := 0, len(registers)-1; i < j; i, j = i+1, j-1 {
+			registers[i], registers[j] = registers[j], registers[i]
+		}
+	}
+	return registers
+}
+
+// orderedBytes returns the big endian bytes of a value stored in registers.
+func orderedBytes(registers []uint16, order ByteOrder) []byte {
+	// Both swaps are their own inverse.
+	return Uint16ToBytes(orderRegisters(Uint16ToBytes(registers), order))
+}
+
+// registerCount checks that a value is stored in n registers.
+func registerCount(registers []uint16, n int) error {
+	if len(registers) != n {
+		return fmt.Errorf("expected %d registers, got %d", n, len(registers))
+	}
+	return nil
+}
+
+// EncodeUint16 stores a uint16 in a register. Orders that swap bytes store
+// it little endian.
+func EncodeUint16(value uint16, order ByteOrder) []uint16 {
+	bytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(bytes, value)
+	return orderRegisters(bytes, order)
+}
+
+// EncodeInt16 stores an int16 in a register.
+func EncodeInt16(value int16, order ByteOrder) []uint16 {
+	return EncodeUint16(uint16(value), order)
+}
+
+// EncodeUint32 stores a uint32 in two registers.
+func EncodeUint32(value uint32, order ByteOrder) []uint16 {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, value)
+	return orderRegisters(bytes, order)
+}
+
+// EncodeInt32 stores an int32 in two registers.
+func EncodeInt32(value int32, order ByteOrder) []uint16 {
+	return EncodeUint32(uint32(value), order)
+}
+
+// EncodeUint64 stores a uint64 in four registers.
+func EncodeUint64(value uint64, order ByteOrder) []uint16 {
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, value)
+	return orderRegisters(bytes, order)
+}
+
+// EncodeInt64 stores an int64 in four registers.
+func EncodeInt64(value int64, order ByteOrder) []uint16 {
+	return EncodeUint64(uint64(value), order)
+}
+
+// EncodeFloat32 stores an IEEE 754 float32 in two registers.
+func EncodeFloat32(value float32, order ByteOrder) []uint16 {
+	return EncodeUint32(math.Float32bits(value), order)
+}
+
+// EncodeFloat64 stores an IEEE 754 float64 in four registers.
+func EncodeFloat64(value float64, order ByteOrder) []uint16 {
+	return EncodeUint64(math.Float64bits(value), order)
+}
+
+// DecodeUint16 returns the uint16 stored in a register.
+func DecodeUint16(registers []uint16, order ByteOrder) (uint16, error) {
+	if err := registerCount(registers, 1); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(orderedBytes(registers, order)), nil
+}
+
+// DecodeInt16 returns the int16 stored in a register.
+func DecodeInt16(registers []uint16, order ByteOrder) (int16, error) {
+	value, err := DecodeUint16(registers, order)
+	return int16(value), err
+}
+
+// DecodeUint32 returns the uint32 stored in two registers.
+func DecodeUint32(registers []uint16, order ByteOrder) (uint32, error) {
+	if err := registerCount(registers, 2); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(orderedBytes(registers, order)), nil
+}
+
+// DecodeInt32 returns the int32 stored in two registers.
+func DecodeInt32(registers []uint16, order ByteOrder) (int32, error) {
+	value, err := DecodeUint32(registers, order)
+	return int32(value), err
+}
+
+// DecodeUint64 returns the uint64 stored in four registers.
+func DecodeUint64(registers []uint16, order ByteOrder) (uint64, error) {
+	if err := registerCount(registers, 4); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(orderedBytes(registers, order)), nil
+}
+
+// DecodeInt64 returns the int64 stored in four registers.
+func DecodeInt64(registers []uint16, order ByteOrder) (int64, error) {
+	value, err := DecodeUint64(registers, order)
+	return int64(value), err
+}
+
+// DecodeFloat32 returns the float32 stored in two registers.
+func DecodeFloat32(registers []uint16, order ByteOrder) (float32, error) {
+	value, err := DecodeUint32(registers, order)
+	return math.Float32frombits(value), err
+}
+
+// DecodeFloat64 returns the float64 stored in four registers.
+func DecodeFloat64(registers []uint16, order ByteOrder) (float64, error) {
+	value, err := DecodeUint64(registers, order)
+	return math.Float64frombits(value), err
+}
+
+// EncodeString stores an ASCII string in n registers, two characters per
+// register, padded with NUL characters. With ABCD the first character is in
+// the high byte of the first register.
+func EncodeString(s string, n int, order ByteOrder) ([]uint16, error) {
+	if len(s) > 2*n {
+		return nil, fmt.Errorf("string of %d characters does not fit in %d registers", len(s), n)
+	}
+	bytes := make([]byte, 2*n)
+	for i := 0; i < len(s); i++ {
+		if s[i] > 0x7F {
+			return nil, fmt.Errorf("string has a non-ASCII character at %d", i)
+		}
+		bytes[i] = s[i]
+	}
+	return orderRegisters(bytes, order), nil
+}
+
+// DecodeString returns the ASCII string stored in registers, without the
+// NUL characters padding it.
+func DecodeString(registers []uint16, order ByteOrder) (string, error) {
+	bytes := orderedBytes(registers, order)
+	end := len(bytes)
+	for end > 0 && bytes[end-1] == 0 {
+		end--
+	}
+	for i, c := range bytes[:end] {
+		if c > 0x7F {
+			return "", fmt.Errorf("string has a non-ASCII character at %d", i)
+		}
+	}
+	return string(bytes[:end]), nil
+}
+
+// EncodeBCD stores a value in n registers as packed binary coded decimal,
+// four digits per register, most significant digit first with ABCD.
+func EncodeBCD(value uint64, n int, order ByteOrder) ([]uint16, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid register count %d", n)
+	}
+	bytes := make([]byte, 2*n)
+	for i := len(bytes) - 1; i >= 0; i-- {
+		bytes[i] = byte(value%10) | byte(value/10%10)<<4
+		value /= 100
+	}
+	if value != 0 {
+		return nil, fmt.Errorf("value has more than %d digits", 4*n)
+	}
+	return orderRegisters(bytes, order), nil
+}
+
+// DecodeBCD returns the value stored in registers as packed binary coded
+// decimal.
+func DecodeBCD(registers []uint16, order ByteOrder) (uint64, error) {
+	var value uint64
+	for _, b := range orderedBytes(registers, order) {
+		for _, digit := range []byte{b >> 4, b & 0x0F} {
+			if digit > 9 {
+				return 0, fmt.Errorf("invalid BCD digit %x", digit)
+			}
+			if value > (math.MaxUint64-uint64(digit))/10 {
+				return 0, fmt.Errorf("BCD value overflows uint64")
+			}
+			value = value*10 + uint64(digit)
+		}
+	}
+	return value, nil
+}
+
+// readRegisterTable reads n holding or input registers.
+func (s *Server) readRegisterTable(table Table, address uint16, n int) ([]uint16, error) {
+	switch table {
+	case HoldingRegisters:
+		return s.ReadHolding(address, n)
+	case InputRegisters:
+		return s.ReadInput(address, n)
+	}
+	return nil, fmt.Errorf("%v is not a register table", table)
+}
+
+// writeRegisterTable writes holding or input registers.
+func (s *Server) writeRegisterTable(table Table, address uint16, values []uint16) error {
+	switch table {
+	case HoldingRegisters:
+		return s.WriteHolding(address, values)
+	case InputRegisters:
+		return s.WriteInput(address, values)
+	}
+	return fmt.Errorf("%v is not a register table", table)
+}
+
+// WriteValue stores a value in the holding or input registers from address.
+// The value is an int16, uint16, int32, uint32, int64, uint64, float32 or
+// float64, taking one, two or four registers.
+func (s *Server) WriteValue(table Table, address uint16, value interface{}, order ByteOrder) error {
+	var registers []uint16
+	switch v := value.(type) {
+	case int16:
+		registers = EncodeInt16(v, order)
+	case uint16:
+		registers = EncodeUint16(v, order)
+	case int32:
+		registers = EncodeInt32(v, order)
+	case uint32:
+		registers = EncodeUint32(v, order)
+	case int64:
+		registers = EncodeInt64(v, order)
+	case uint64:
+		registers = EncodeUint64(v, order)
+	case float32:
+		registers = EncodeFloat32(v, order)
+	case float64:
+		registers = EncodeFloat64(v, order)
+	default:
+		return fmt.Errorf("unsupported value type %T", value)
+	}
+	return s.writeRegisterTable(table, address, registers)
+}
+
+// ReadValue decodes the holding or input registers from address into the
+// value pointed to, a *int16, *uint16, *int32, *uint32, *int64, *uint64,
+// *float32 or *float64.
+func (s *Server) ReadValue(table Table, address uint16, value interface{}, order ByteOrder) error {
+	var n int
+	switch value.(type) {
+	case *int16, *uint16:
+		n = 1
+	case *int32, *uint32, *float32:
+		n = 2
+	case *int64, *uint64, *float64:
+		n = 4
+	default:
+		return fmt.Errorf("unsupported value type %T", value)
+	}
+	registers, err := s.readRegisterTable(table, address, n)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case *int16:
+		*v, err = DecodeInt16(registers, order)
+	case *uint16:
+		*v, err = DecodeUint16(registers, order)
+	case *int32:
+		*v, err = DecodeInt32(registers, order)
+	case *uint32:
+		*v, err = DecodeUint32(registers, order)
+	case *float32:
+		*v, err = DecodeFloat32(registers, order)
+	case *int64:
+		*v, err = DecodeInt64(registers, order)
+	case *uint64:
+		*v, err = DecodeUint64(registers, order)
+	case *float64:
+		*v, err = DecodeFloat64(registers, order)
+	}
+	return err
+}
+
+// WriteString stores an ASCII string in n holding or input registers from
+// address, padded with NUL characters.
+func (s *Server) WriteString(table Table, address uint16, value string, n int, order ByteOrder) error {
+	registers, err := EncodeString(value, n, order)
+	if err != nil {
+		return err
+	}
+	return s.writeRegisterTable(table, address, registers)
+}
+
+// ReadString returns the ASCII string stored in n holding or input registers
+// from address.
+func (s *Server) ReadString(table Table, address uint16, n int, order ByteOrder) (string, error) {
+	registers, err := s.readRegisterTable(table, address, n)
+	if err != nil {
+		return "", err
+	}
+	return DecodeString(registers, order)
+}
+
+// WriteBCD stores a value as packed BCD in n holding or input registers from
+// address.
+func (s *Server) WriteBCD(table Table, address uint16, value uint64, n int, order ByteOrder) error {
+	registers, err := EncodeBCD(value, n, order)
+	if err != nil {
+		return err
+	}
+	return s.writeRegisterTable(table, address, registers)
+}
+
+// ReadBCD returns the packed BCD value stored in n holding or input registers
+// from address.
+func (s *Server) ReadBCD(table Table, address uint16, n int, order ByteOrder) (uint64, error) {
+	registers, err := s.readRegisterTable(table, address, n)
+	if err != nil {
+		return 0, err
+	}
+	return DecodeBCD(registers, order)
+}
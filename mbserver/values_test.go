@@ -0,0 +1,156 @@
+package mbserver
+
+import (
+	"math"
+	"testing"
+)
+
+func TestByteOrders(t *testing.T) {
+	tests := []struct {
+		order ByteOrder
+		u16   []uint16
+		f32   []uint16
+		u64   []uint16
+	}{
+		{ABCD, []uint16{0x0102}, []uint16{0x3F80, 0x0000}, []uint16{0x0102, 0x0304, 0x0506, 0x0708}},
+		{DCBA, []uint16{0x0201}, []uint16{0x0000, 0x803F}, []uint16{0x0807, 0x0605, 0x0403, 0x0201}},
+		{BADC, []uint16{0x0201}, []uint16{0x803F, 0x0000}, []uint16{0x0201, 0x0403, 0x0605, 0x0807}},
+		{CDAB, []uint16{0x0102}, []uint16{0x0000, 0x3F80}, []uint16{0x0708, 0x0506, 0x0304, 0x0102}},
+	}
+	for _, test := range tests {
+		if got := EncodeUint16(0x0102, test.order); !isEqual(test.u16, got) {
+			t.Errorf("%v uint16: expected %v, got %v", test.order, test.u16, got)
+		}
+		if got := EncodeFloat32(1, test.order); !isEqual(test.f32, got) {
+			t.Errorf("%v float32: expected %v, got %v", test.order, test.f32, got)
+		}
+		if got := EncodeUint64(0x0102030405060708, test.order); !isEqual(test.u64, got) {
+			t.Errorf("%v uint64: expected %v, got %v", test.order, test.u64, got)
+		}
+
+		if got, err := DecodeUint16(test.u16, test.order); err != nil || got != 0x0102 {
+			t.Errorf("%v uint16: expected %v, got %v %v", test.order, 0x0102, got, err)
+		}
+		if got, err := DecodeFloat32(test.f32, test.order); err != nil || got != 1 {
+			t.Errorf("%v float32: expected %v, got %v %v", test.order, 1, got, err)
+		}
+		if got, err := DecodeUint64(test.u64, test.order); err != nil || got != 0x0102030405060708 {
+			t.Errorf("%v uint64: expected %v, got %v %v", test.order, 0x0102030405060708, got, err)
+		}
+	}
+}
+
+func TestValueRoundTrip(t *testing.T) {
+	for _, order := range []ByteOrder{ABCD, DCBA, BADC, CDAB} {
+		if got, _ := DecodeInt16(EncodeInt16(-2, order), order); got != -2 {
+			t.Errorf("%v int16: expected %v, got %v", order, -2, got)
+		}
+		if got, _ := DecodeInt32(EncodeInt32(-70000, order), order); got != -70000 {
+			t.Errorf("%v int32: expected %v, got %v", order, -70000, got)
+		}
+		if got, _ := DecodeUint32(EncodeUint32(0xDEADBEEF, order), order); got != 0xDEADBEEF {
+			t.Errorf("%v uint32: expected %v, got %v", order, 0xDEADBEEF, got)
+		}
+		if got, _ := DecodeInt64(EncodeInt64(math.MinInt64, order), order); got != math.MinInt64 {
+			t.Errorf("%v int64: expected %v, got %v", order, math.MinInt64, got)
+		}
+		if got, _ := DecodeFloat64(EncodeFloat64(-12.5e100, order), order); got != -12.5e100 {
+			t.Errorf("%v float64: expected %v, got %v", order, -12.5e100, got)
+		}
+	}
+
+	if _, err := DecodeFloat32([]uint16{1}, ABCD); err == nil {
+		t.Errorf("expected an error decoding a float32 from one register")
+	}
+}
+
+func TestStrings(t *testing.T) {
+	registers, err := EncodeString("ABC", 3, ABCD)
+	if err != nil || !isEqual([]uint16{0x4142, 0x4300, 0}, registers) {
+		t.Errorf("expected %v, got %v %v", []uint16{0x4142, 0x4300, 0}, registers, err)
+	}
+	registers, _ = EncodeString("ABC", 3, BADC)
+	if !isEqual([]uint16{0x4241, 0x0043, 0}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{0x4241, 0x0043, 0}, registers)
+	}
+	if got, err := DecodeString(registers, BADC); err != nil || got != "ABC" {
+		t.Errorf("expected %v, got %v %v", "ABC", got, err)
+	}
+
+	if _, err := EncodeString("ABCDE", 2, ABCD); err == nil {
+		t.Errorf("expected an error for a string that does not fit")
+	}
+	if _, err := EncodeString("é", 2, ABCD); err == nil {
+		t.Errorf("expected an error for a non-ASCII string")
+	}
+}
+
+func TestBCD(t *testing.T) {
+	registers, err := EncodeBCD(12345678, 2, ABCD)
+	if err != nil || !isEqual([]uint16{0x1234, 0x5678}, registers) {
+		t.Errorf("expected %v, got %v %v", []uint16{0x1234, 0x5678}, registers, err)
+	}
+	registers, _ = EncodeBCD(12345678, 2, CDAB)
+	if !isEqual([]uint16{0x5678, 0x1234}, registers) {
+		t.Errorf("expected %v, got %v", []uint16{0x5678, 0x1234}, registers)
+	}
+	if got, err := DecodeBCD(registers, CDAB); err != nil || got != 12345678 {
+		t.Errorf("expected %v, got %v %v", 12345678, got, err)
+	}
+
+	if _, err := EncodeBCD(12345, 1, ABCD); err == nil {
+		t.Errorf("expected an error for a value with too many digits")
+	}
+	for _, n := range []int{0, -1} {
+		if _, err := EncodeBCD(0, n, ABCD); err == nil {
+			t.Errorf("expected an error for %v registers", n)
+		}
+	}
+	if _, err := DecodeBCD([]uint16{0x12A4}, ABCD); err == nil {
+		t.Errorf("expected an error for an invalid digit")
+	}
+	if _, err := DecodeBCD([]uint16{0x9999, 0x9999, 0x9999, 0x9999, 0x9999}, ABCD); err == nil {
+		t.Errorf("expected an error for a value overflowing uint64")
+	}
+}
+
+func TestServerValues(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	if err := s.WriteValue(HoldingRegisters, 10, float32(1), CDAB); err != nil {
+		t.Fatalf("expected nil, got %v", err)
+	}
+	if got, _ := s.ReadHolding(10, 2); !isEqual([]uint16{0, 0x3F80}, got) {
+		t.Errorf("expected %v, got %v", []uint16{0, 0x3F80}, got)
+	}
+	var f float32
+	if err := s.ReadValue(HoldingRegisters, 10, &f, CDAB); err != nil || f != 1 {
+		t.Errorf("expected %v, got %v %v", 1, f, err)
+	}
+
+	s.WriteValue(InputRegisters, 0, int64(-5), DCBA)
+	var i int64
+	if err := s.ReadValue(InputRegisters, 0, &i, DCBA); err != nil || i != -5 {
+		t.Errorf("expected %v, got %v %v", -5, i, err)
+	}
+
+	s.WriteString(HoldingRegisters, 20, "pump", 4, ABCD)
+	if got, err := s.ReadString(HoldingRegisters, 20, 4, ABCD); err != nil || got != "pump" {
+		t.Errorf("expected %v, got %v %v", "pump", got, err)
+	}
+	s.WriteBCD(InputRegisters, 30, 1999, 1, ABCD)
+	if got, err := s.ReadBCD(InputRegisters, 30, 1, ABCD); err != nil || got != 1999 {
+		t.Errorf("expected %v, got %v %v", 1999, got, err)
+	}
+
+	if err := s.WriteValue(Coils, 0, uint16(1), ABCD); err == nil {
+		t.Errorf("expected an error writing to coils")
+	}
+	if err := s.WriteValue(HoldingRegisters, 0, 1, ABCD); err == nil {
+		t.Errorf("expected an error for an int")
+	}
+	if err := s.ReadValue(HoldingRegisters, 65535, &f, ABCD); err != IllegalDataAddress {
+		t.Errorf("expected %v, got %v", IllegalDataAddress, err)
+	}
+}